@@ -60,3 +60,185 @@ func IsOpenaiError(err error) bool {
 func ErrorOpenaiError(format string, args ...interface{}) *errors.Error {
 	return errors.New(503, ErrorReason_OPENAI_ERROR.String(), fmt.Sprintf(format, args...))
 }
+
+func IsSendTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	e := errors.FromError(err)
+	return e.Reason == ErrorReason_SEND_TIMEOUT.String() && e.Code == 504
+}
+
+func ErrorSendTimeout(format string, args ...interface{}) *errors.Error {
+	return errors.New(504, ErrorReason_SEND_TIMEOUT.String(), fmt.Sprintf(format, args...))
+}
+
+func IsRequestTooLarge(err error) bool {
+	if err == nil {
+		return false
+	}
+	e := errors.FromError(err)
+	return e.Reason == ErrorReason_REQUEST_TOO_LARGE.String() && e.Code == 400
+}
+
+func ErrorRequestTooLarge(format string, args ...interface{}) *errors.Error {
+	return errors.New(400, ErrorReason_REQUEST_TOO_LARGE.String(), fmt.Sprintf(format, args...))
+}
+
+func IsInternalError(err error) bool {
+	if err == nil {
+		return false
+	}
+	e := errors.FromError(err)
+	return e.Reason == ErrorReason_INTERNAL_ERROR.String() && e.Code == 500
+}
+
+func ErrorInternalError(format string, args ...interface{}) *errors.Error {
+	return errors.New(500, ErrorReason_INTERNAL_ERROR.String(), fmt.Sprintf(format, args...))
+}
+
+func IsStreamNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	e := errors.FromError(err)
+	return e.Reason == ErrorReason_STREAM_NOT_FOUND.String() && e.Code == 404
+}
+
+func ErrorStreamNotFound(format string, args ...interface{}) *errors.Error {
+	return errors.New(404, ErrorReason_STREAM_NOT_FOUND.String(), fmt.Sprintf(format, args...))
+}
+
+func IsStreamAlreadyExists(err error) bool {
+	if err == nil {
+		return false
+	}
+	e := errors.FromError(err)
+	return e.Reason == ErrorReason_STREAM_ALREADY_EXISTS.String() && e.Code == 409
+}
+
+func ErrorStreamAlreadyExists(format string, args ...interface{}) *errors.Error {
+	return errors.New(409, ErrorReason_STREAM_ALREADY_EXISTS.String(), fmt.Sprintf(format, args...))
+}
+
+func IsStreamCancelled(err error) bool {
+	if err == nil {
+		return false
+	}
+	e := errors.FromError(err)
+	return e.Reason == ErrorReason_STREAM_CANCELLED.String() && e.Code == 499
+}
+
+func ErrorStreamCancelled(format string, args ...interface{}) *errors.Error {
+	return errors.New(499, ErrorReason_STREAM_CANCELLED.String(), fmt.Sprintf(format, args...))
+}
+
+func IsUnauthenticated(err error) bool {
+	if err == nil {
+		return false
+	}
+	e := errors.FromError(err)
+	return e.Reason == ErrorReason_UNAUTHENTICATED.String() && e.Code == 401
+}
+
+func ErrorUnauthenticated(format string, args ...interface{}) *errors.Error {
+	return errors.New(401, ErrorReason_UNAUTHENTICATED.String(), fmt.Sprintf(format, args...))
+}
+
+func IsQuotaExceeded(err error) bool {
+	if err == nil {
+		return false
+	}
+	e := errors.FromError(err)
+	return e.Reason == ErrorReason_QUOTA_EXCEEDED.String() && e.Code == 429
+}
+
+func ErrorQuotaExceeded(format string, args ...interface{}) *errors.Error {
+	return errors.New(429, ErrorReason_QUOTA_EXCEEDED.String(), fmt.Sprintf(format, args...))
+}
+
+func IsStreamTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	e := errors.FromError(err)
+	return e.Reason == ErrorReason_STREAM_TIMEOUT.String() && e.Code == 504
+}
+
+func ErrorStreamTimeout(format string, args ...interface{}) *errors.Error {
+	return errors.New(504, ErrorReason_STREAM_TIMEOUT.String(), fmt.Sprintf(format, args...))
+}
+
+func IsUpstreamTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	e := errors.FromError(err)
+	return e.Reason == ErrorReason_UPSTREAM_TIMEOUT.String() && e.Code == 504
+}
+
+func ErrorUpstreamTimeout(format string, args ...interface{}) *errors.Error {
+	return errors.New(504, ErrorReason_UPSTREAM_TIMEOUT.String(), fmt.Sprintf(format, args...))
+}
+
+func IsInvalidParameter(err error) bool {
+	if err == nil {
+		return false
+	}
+	e := errors.FromError(err)
+	return e.Reason == ErrorReason_INVALID_PARAMETER.String() && e.Code == 400
+}
+
+func ErrorInvalidParameter(format string, args ...interface{}) *errors.Error {
+	return errors.New(400, ErrorReason_INVALID_PARAMETER.String(), fmt.Sprintf(format, args...))
+}
+
+func IsTooManyStreams(err error) bool {
+	if err == nil {
+		return false
+	}
+	e := errors.FromError(err)
+	return e.Reason == ErrorReason_TOO_MANY_STREAMS.String() && e.Code == 429
+}
+
+func ErrorTooManyStreams(format string, args ...interface{}) *errors.Error {
+	return errors.New(429, ErrorReason_TOO_MANY_STREAMS.String(), fmt.Sprintf(format, args...))
+}
+
+func IsForbidden(err error) bool {
+	if err == nil {
+		return false
+	}
+	e := errors.FromError(err)
+	return e.Reason == ErrorReason_FORBIDDEN.String() && e.Code == 403
+}
+
+func ErrorForbidden(format string, args ...interface{}) *errors.Error {
+	return errors.New(403, ErrorReason_FORBIDDEN.String(), fmt.Sprintf(format, args...))
+}
+
+// 上游拒绝了 token，区别于代理自身的 UNAUTHENTICATED 与 FORBIDDEN
+func IsUpstreamUnauthenticated(err error) bool {
+	if err == nil {
+		return false
+	}
+	e := errors.FromError(err)
+	return e.Reason == ErrorReason_UPSTREAM_UNAUTHENTICATED.String() && e.Code == 401
+}
+
+// 上游拒绝了 token，区别于代理自身的 UNAUTHENTICATED 与 FORBIDDEN
+func ErrorUpstreamUnauthenticated(format string, args ...interface{}) *errors.Error {
+	return errors.New(401, ErrorReason_UPSTREAM_UNAUTHENTICATED.String(), fmt.Sprintf(format, args...))
+}
+
+func IsUpstreamForbidden(err error) bool {
+	if err == nil {
+		return false
+	}
+	e := errors.FromError(err)
+	return e.Reason == ErrorReason_UPSTREAM_FORBIDDEN.String() && e.Code == 403
+}
+
+func ErrorUpstreamForbidden(format string, args ...interface{}) *errors.Error {
+	return errors.New(403, ErrorReason_UPSTREAM_FORBIDDEN.String(), fmt.Sprintf(format, args...))
+}
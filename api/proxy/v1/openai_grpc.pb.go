@@ -21,6 +21,10 @@ const _ = grpc.SupportPackageIsVersion8
 const (
 	OpenAI_ChatCompletion_FullMethodName       = "/proxy.v1.OpenAI/ChatCompletion"
 	OpenAI_StreamChatCompletion_FullMethodName = "/proxy.v1.OpenAI/StreamChatCompletion"
+	OpenAI_CancelStream_FullMethodName         = "/proxy.v1.OpenAI/CancelStream"
+	OpenAI_ListModels_FullMethodName           = "/proxy.v1.OpenAI/ListModels"
+	OpenAI_ListStreams_FullMethodName          = "/proxy.v1.OpenAI/ListStreams"
+	OpenAI_ValidateToken_FullMethodName        = "/proxy.v1.OpenAI/ValidateToken"
 )
 
 // OpenAIClient is the client API for OpenAI service.
@@ -29,6 +33,14 @@ const (
 type OpenAIClient interface {
 	ChatCompletion(ctx context.Context, in *ChatCompletionRequest, opts ...grpc.CallOption) (*ChatCompletionResponse, error)
 	StreamChatCompletion(ctx context.Context, in *StreamChatCompletionRequest, opts ...grpc.CallOption) (OpenAI_StreamChatCompletionClient, error)
+	// 仅限流的发起方或 proxy.admin 中配置的调用方
+	CancelStream(ctx context.Context, in *CancelStreamRequest, opts ...grpc.CallOption) (*CancelStreamResponse, error)
+	ListModels(ctx context.Context, in *ListModelsRequest, opts ...grpc.CallOption) (*ListModelsResponse, error)
+	// 列出进行中的流，仅限 proxy.admin 中配置的调用方
+	ListStreams(ctx context.Context, in *ListStreamsRequest, opts ...grpc.CallOption) (*ListStreamsResponse, error)
+	// 通过列出上游模型校验 token，不产生补全费用；上游拒绝时返回
+	// UPSTREAM_UNAUTHENTICATED 或 UPSTREAM_FORBIDDEN
+	ValidateToken(ctx context.Context, in *ValidateTokenRequest, opts ...grpc.CallOption) (*ValidateTokenResponse, error)
 }
 
 type openAIClient struct {
@@ -82,12 +94,60 @@ func (x *openAIStreamChatCompletionClient) Recv() (*StreamChatCompletionResponse
 	return m, nil
 }
 
+func (c *openAIClient) CancelStream(ctx context.Context, in *CancelStreamRequest, opts ...grpc.CallOption) (*CancelStreamResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CancelStreamResponse)
+	err := c.cc.Invoke(ctx, OpenAI_CancelStream_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *openAIClient) ListModels(ctx context.Context, in *ListModelsRequest, opts ...grpc.CallOption) (*ListModelsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListModelsResponse)
+	err := c.cc.Invoke(ctx, OpenAI_ListModels_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *openAIClient) ListStreams(ctx context.Context, in *ListStreamsRequest, opts ...grpc.CallOption) (*ListStreamsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListStreamsResponse)
+	err := c.cc.Invoke(ctx, OpenAI_ListStreams_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *openAIClient) ValidateToken(ctx context.Context, in *ValidateTokenRequest, opts ...grpc.CallOption) (*ValidateTokenResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ValidateTokenResponse)
+	err := c.cc.Invoke(ctx, OpenAI_ValidateToken_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // OpenAIServer is the server API for OpenAI service.
 // All implementations must embed UnimplementedOpenAIServer
 // for forward compatibility
 type OpenAIServer interface {
 	ChatCompletion(context.Context, *ChatCompletionRequest) (*ChatCompletionResponse, error)
 	StreamChatCompletion(*StreamChatCompletionRequest, OpenAI_StreamChatCompletionServer) error
+	// 仅限流的发起方或 proxy.admin 中配置的调用方
+	CancelStream(context.Context, *CancelStreamRequest) (*CancelStreamResponse, error)
+	ListModels(context.Context, *ListModelsRequest) (*ListModelsResponse, error)
+	// 列出进行中的流，仅限 proxy.admin 中配置的调用方
+	ListStreams(context.Context, *ListStreamsRequest) (*ListStreamsResponse, error)
+	// 通过列出上游模型校验 token，不产生补全费用；上游拒绝时返回
+	// UPSTREAM_UNAUTHENTICATED 或 UPSTREAM_FORBIDDEN
+	ValidateToken(context.Context, *ValidateTokenRequest) (*ValidateTokenResponse, error)
 	mustEmbedUnimplementedOpenAIServer()
 }
 
@@ -101,6 +161,18 @@ func (UnimplementedOpenAIServer) ChatCompletion(context.Context, *ChatCompletion
 func (UnimplementedOpenAIServer) StreamChatCompletion(*StreamChatCompletionRequest, OpenAI_StreamChatCompletionServer) error {
 	return status.Errorf(codes.Unimplemented, "method StreamChatCompletion not implemented")
 }
+func (UnimplementedOpenAIServer) CancelStream(context.Context, *CancelStreamRequest) (*CancelStreamResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CancelStream not implemented")
+}
+func (UnimplementedOpenAIServer) ListModels(context.Context, *ListModelsRequest) (*ListModelsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListModels not implemented")
+}
+func (UnimplementedOpenAIServer) ListStreams(context.Context, *ListStreamsRequest) (*ListStreamsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListStreams not implemented")
+}
+func (UnimplementedOpenAIServer) ValidateToken(context.Context, *ValidateTokenRequest) (*ValidateTokenResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ValidateToken not implemented")
+}
 func (UnimplementedOpenAIServer) mustEmbedUnimplementedOpenAIServer() {}
 
 // UnsafeOpenAIServer may be embedded to opt out of forward compatibility for this service.
@@ -153,6 +225,78 @@ func (x *openAIStreamChatCompletionServer) Send(m *StreamChatCompletionResponse)
 	return x.ServerStream.SendMsg(m)
 }
 
+func _OpenAI_CancelStream_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CancelStreamRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OpenAIServer).CancelStream(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OpenAI_CancelStream_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OpenAIServer).CancelStream(ctx, req.(*CancelStreamRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OpenAI_ListModels_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListModelsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OpenAIServer).ListModels(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OpenAI_ListModels_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OpenAIServer).ListModels(ctx, req.(*ListModelsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OpenAI_ListStreams_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListStreamsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OpenAIServer).ListStreams(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OpenAI_ListStreams_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OpenAIServer).ListStreams(ctx, req.(*ListStreamsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OpenAI_ValidateToken_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ValidateTokenRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OpenAIServer).ValidateToken(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OpenAI_ValidateToken_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OpenAIServer).ValidateToken(ctx, req.(*ValidateTokenRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // OpenAI_ServiceDesc is the grpc.ServiceDesc for OpenAI service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -164,6 +308,22 @@ var OpenAI_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "ChatCompletion",
 			Handler:    _OpenAI_ChatCompletion_Handler,
 		},
+		{
+			MethodName: "CancelStream",
+			Handler:    _OpenAI_CancelStream_Handler,
+		},
+		{
+			MethodName: "ListModels",
+			Handler:    _OpenAI_ListModels_Handler,
+		},
+		{
+			MethodName: "ListStreams",
+			Handler:    _OpenAI_ListStreams_Handler,
+		},
+		{
+			MethodName: "ValidateToken",
+			Handler:    _OpenAI_ValidateToken_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
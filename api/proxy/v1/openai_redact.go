@@ -0,0 +1,33 @@
+package v1
+
+import "google.golang.org/protobuf/proto"
+
+// Redact implements the kratos logging Redacter so upstream tokens never reach
+// the access log.
+func (x *ChatCompletionRequest) Redact() string {
+	r := proto.Clone(x).(*ChatCompletionRequest)
+	if r.Token != "" {
+		r.Token = "***"
+	}
+	return r.String()
+}
+
+// Redact implements the kratos logging Redacter so upstream tokens never reach
+// the access log.
+func (x *StreamChatCompletionRequest) Redact() string {
+	r := proto.Clone(x).(*StreamChatCompletionRequest)
+	if r.Token != "" {
+		r.Token = "***"
+	}
+	return r.String()
+}
+
+// Redact implements the kratos logging Redacter so upstream tokens never reach
+// the access log.
+func (x *ValidateTokenRequest) Redact() string {
+	r := proto.Clone(x).(*ValidateTokenRequest)
+	if r.Token != "" {
+		r.Token = "***"
+	}
+	return r.String()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var placeholder = regexp.MustCompile(`\${(.*?)}`)
+
+// expandResolver replaces the default config resolver. It expands ${NAME} and
+// ${NAME:default} from the environment and replaces values of the form
+// file:/path with the contents of that file, so secrets can be injected by the
+// platform. Unresolved placeholders and unreadable files fail the load.
+func expandResolver(input map[string]interface{}) error {
+	var missing []string
+	expand := func(s string) string {
+		s = placeholder.ReplaceAllStringFunc(s, func(m string) string {
+			name, def, hasDef := strings.Cut(placeholder.FindStringSubmatch(m)[1], ":")
+			if v, ok := os.LookupEnv(name); ok {
+				return v
+			}
+			if hasDef {
+				return def
+			}
+			missing = append(missing, "${"+name+"}")
+			return m
+		})
+		if path, ok := strings.CutPrefix(s, "file:"); ok {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				missing = append(missing, s)
+				return s
+			}
+			return strings.TrimRight(string(b), "\r\n")
+		}
+		return s
+	}
+
+	var resolve func(v interface{}) interface{}
+	resolve = func(v interface{}) interface{} {
+		switch vt := v.(type) {
+		case string:
+			return expand(vt)
+		case map[string]interface{}:
+			for k, sub := range vt {
+				vt[k] = resolve(sub)
+			}
+		case []interface{}:
+			for i, sub := range vt {
+				vt[i] = resolve(sub)
+			}
+		}
+		return v
+	}
+	resolve(input)
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("unresolved config values: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
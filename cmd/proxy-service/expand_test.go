@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kratos/kratos/v2/config"
+	"github.com/go-kratos/kratos/v2/config/file"
+
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+// loadConfig loads yaml through the same source and resolver as main.
+func loadConfig(t *testing.T, yaml string) (*conf.Bootstrap, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c := config.New(
+		config.WithSource(file.NewSource(path)),
+		config.WithResolver(expandResolver),
+	)
+	defer c.Close()
+
+	if err := c.Load(); err != nil {
+		return nil, err
+	}
+	var bc conf.Bootstrap
+	if err := c.Scan(&bc); err != nil {
+		return nil, err
+	}
+	return &bc, nil
+}
+
+func TestExpandResolver(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(secret, []byte("sk-from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PROXY_TEST_CERT", "/etc/tls/cert.pem")
+	t.Setenv("PROXY_TEST_SECRET", secret)
+
+	bc, err := loadConfig(t, `
+server:
+  grpc:
+    addr: ${PROXY_TEST_ADDR:0.0.0.0:9000}
+    tls:
+      cert_file: ${PROXY_TEST_CERT}
+  auth:
+    keys:
+      - name: ci
+        sha256: prefix-${PROXY_TEST_CERT}-suffix
+proxy:
+  vault:
+    tokens:
+      team: file:${PROXY_TEST_SECRET}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := bc.GetServer().GetGrpc().GetAddr(); got != "0.0.0.0:9000" {
+		t.Errorf("default: got %q", got)
+	}
+	if got := bc.GetServer().GetGrpc().GetTls().GetCertFile(); got != "/etc/tls/cert.pem" {
+		t.Errorf("env: got %q", got)
+	}
+	if got := bc.GetServer().GetAuth().GetKeys()[0].GetSha256(); got != "prefix-/etc/tls/cert.pem-suffix" {
+		t.Errorf("embedded env in a list: got %q", got)
+	}
+	if got := bc.GetProxy().GetVault().GetTokens()["team"]; got != "sk-from-file" {
+		t.Errorf("secret file: got %q", got)
+	}
+}
+
+func TestExpandResolverUnresolved(t *testing.T) {
+	_, err := loadConfig(t, `
+server:
+  grpc:
+    addr: ${PROXY_TEST_UNSET_ADDR}
+proxy:
+  upstream:
+    base_url: ${PROXY_TEST_UNSET_URL}
+  vault:
+    tokens:
+      team: file:/nonexistent/proxy-test-secret
+`)
+	if err == nil {
+		t.Fatal("expected unresolved values to fail the load")
+	}
+	for _, want := range []string{"${PROXY_TEST_UNSET_ADDR}", "${PROXY_TEST_UNSET_URL}", "file:/nonexistent/proxy-test-secret"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not list %s", err, want)
+		}
+	}
+}
+
+func TestExpandResolverEmptyEnv(t *testing.T) {
+	t.Setenv("PROXY_TEST_EMPTY", "")
+	bc, err := loadConfig(t, `
+proxy:
+  upstream:
+    base_url: ${PROXY_TEST_EMPTY:https://example.com}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bc.GetProxy().GetUpstream().GetBaseUrl(); got != "" {
+		t.Errorf("a set but empty variable should win over the default, got %q", got)
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"os"
 
+	"github.com/wolodata/proxy-service/internal/auth"
 	"github.com/wolodata/proxy-service/internal/conf"
+	"github.com/wolodata/proxy-service/internal/server"
+	"github.com/wolodata/proxy-service/internal/service"
 
 	"github.com/go-kratos/kratos/v2"
 	"github.com/go-kratos/kratos/v2/config"
@@ -31,7 +35,7 @@ func init() {
 	flag.StringVar(&flagconf, "conf", "../../configs", "config path, eg: -conf config.yaml")
 }
 
-func newApp(logger log.Logger, gs *grpc.Server) *kratos.App {
+func newApp(logger log.Logger, gs *grpc.Server, hp *server.HealthProber) *kratos.App {
 	return kratos.New(
 		kratos.ID(id),
 		kratos.Name(Name),
@@ -40,6 +44,7 @@ func newApp(logger log.Logger, gs *grpc.Server) *kratos.App {
 		kratos.Logger(logger),
 		kratos.Server(
 			gs,
+			hp,
 		),
 	)
 }
@@ -54,11 +59,13 @@ func main() {
 		"service.version", Version,
 		"trace.id", tracing.TraceID(),
 		"span.id", tracing.SpanID(),
+		"auth.caller", auth.Caller(),
 	)
 	c := config.New(
 		config.WithSource(
 			file.NewSource(flagconf),
 		),
+		config.WithResolver(expandResolver),
 	)
 	defer c.Close()
 
@@ -71,7 +78,12 @@ func main() {
 		panic(err)
 	}
 
-	app, cleanup, err := wireApp(bc.Server, bc.Data, logger)
+	rc := service.NewRuntimeConfig(bc.Proxy)
+	if err := watchProxy(c, rc, logger); err != nil {
+		panic(err)
+	}
+
+	app, cleanup, err := wireApp(bc.Server, bc.Data, bc.Proxy, rc, logger)
 	if err != nil {
 		panic(err)
 	}
@@ -82,3 +94,35 @@ func main() {
 		panic(err)
 	}
 }
+
+// watchProxy reloads rc whenever the proxy section of c changes. A config
+// without a proxy section runs on the code defaults and is not watched.
+func watchProxy(c config.Config, rc *service.RuntimeConfig, logger log.Logger) error {
+	err := c.Watch("proxy", func(string, config.Value) {
+		reloadProxy(c, rc, logger)
+	})
+	if errors.Is(err, config.ErrNotFound) {
+		log.NewHelper(logger).Warn("config has no proxy section, using defaults without hot reload")
+		return nil
+	}
+	return err
+}
+
+// reloadProxy applies changed proxy settings from c to rc. Server settings and
+// the static proxy keys are only read at startup.
+func reloadProxy(c config.Config, rc *service.RuntimeConfig, logger log.Logger) {
+	helper := log.NewHelper(logger)
+
+	var bc conf.Bootstrap
+	if err := c.Scan(&bc); err != nil {
+		helper.Errorf("reload config: %v", err)
+		return
+	}
+	applied, ignored := rc.Update(bc.Proxy)
+	if len(applied) > 0 {
+		helper.Infof("reloaded proxy config: %v", applied)
+	}
+	if len(ignored) > 0 {
+		helper.Warnf("proxy config changes need a restart: %v", ignored)
+	}
+}
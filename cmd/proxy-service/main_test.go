@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/config"
+	"github.com/go-kratos/kratos/v2/config/file"
+	"github.com/go-kratos/kratos/v2/log"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/conf"
+	"github.com/wolodata/proxy-service/internal/service"
+)
+
+// openConfig loads path the way main does.
+func openConfig(t *testing.T, path string) (config.Config, *conf.Bootstrap) {
+	t.Helper()
+	c := config.New(
+		config.WithSource(file.NewSource(path)),
+		config.WithResolver(expandResolver),
+	)
+	t.Cleanup(func() { c.Close() })
+	if err := c.Load(); err != nil {
+		t.Fatal(err)
+	}
+	var bc conf.Bootstrap
+	if err := c.Scan(&bc); err != nil {
+		t.Fatal(err)
+	}
+	return c, &bc
+}
+
+// syncBuffer is a log sink shared with the config watcher goroutine.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func writeConfig(t *testing.T, path, yaml string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchProxyWithoutProxySection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, "server:\n  grpc:\n    addr: 0.0.0.0:9000\n")
+	c, bc := openConfig(t, path)
+
+	var logs bytes.Buffer
+	if err := watchProxy(c, service.NewRuntimeConfig(bc.Proxy), log.NewStdLogger(&logs)); err != nil {
+		t.Fatalf("watchProxy = %v, want the defaults to be used", err)
+	}
+	if !strings.Contains(logs.String(), "no proxy section") {
+		t.Fatalf("missing proxy section not logged: %q", logs.String())
+	}
+}
+
+func TestReloadAppliesNewLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"hello"}}]}`)
+	}))
+	defer upstream.Close()
+
+	const tmpl = "proxy:\n  upstream:\n    base_url: %s\n  limits:\n    max_messages: %d\n"
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, fmt.Sprintf(tmpl, upstream.URL, 2))
+	c, bc := openConfig(t, path)
+
+	rc := service.NewRuntimeConfig(bc.Proxy)
+	var logs syncBuffer
+	logger := log.NewStdLogger(&logs)
+	if err := watchProxy(c, rc, logger); err != nil {
+		t.Fatal(err)
+	}
+	httpClient, err := service.NewHTTPClient(bc.Proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := service.NewOpenAIService(bc.Proxy, rc, httpClient, nil, service.NewQuotaStore(), logger)
+
+	req := &pb.ChatCompletionRequest{
+		Model: "gpt-4o",
+		Messages: []*pb.ChatCompletionMessage{
+			{Role: pb.ChatCompletionMessageRole_CHAT_COMPLETION_MESSAGE_ROLE_USER, Content: "a"},
+			{Role: pb.ChatCompletionMessageRole_CHAT_COMPLETION_MESSAGE_ROLE_USER, Content: "b"},
+		},
+	}
+	if _, err := s.ChatCompletion(context.Background(), req); err != nil {
+		t.Fatalf("request within the initial limit: %v", err)
+	}
+
+	writeConfig(t, path, fmt.Sprintf(tmpl, upstream.URL, 1))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := s.ChatCompletion(context.Background(), req)
+		if pb.IsRequestTooLarge(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("new max_messages not applied, last err = %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for !strings.Contains(logs.String(), "reloaded proxy config: [limits]") {
+		if time.Now().After(deadline) {
+			t.Fatalf("applied keys not logged: %q", logs.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -21,10 +21,20 @@ import (
 // Injectors from wire.go:
 
 // wireApp init kratos application.
-func wireApp(confServer *conf.Server, data *conf.Data, logger log.Logger) (*kratos.App, func(), error) {
-	openAIService := service.NewOpenAIService()
-	grpcServer := server.NewGRPCServer(confServer, openAIService, logger)
-	app := newApp(logger, grpcServer)
+func wireApp(confServer *conf.Server, data *conf.Data, proxy *conf.Proxy, runtimeConfig *service.RuntimeConfig, logger log.Logger) (*kratos.App, func(), error) {
+	client, err := service.NewHTTPClient(proxy)
+	if err != nil {
+		return nil, nil, err
+	}
+	v := service.NewResponseInterceptors(proxy)
+	quotaStore := service.NewQuotaStore()
+	openAIService := service.NewOpenAIService(proxy, runtimeConfig, client, v, quotaStore, logger)
+	healthProber := server.NewHealthProber(confServer, proxy, logger)
+	grpcServer, err := server.NewGRPCServer(confServer, openAIService, healthProber, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	app := newApp(logger, grpcServer, healthProber)
 	return app, func() {
 	}, nil
 }
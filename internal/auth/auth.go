@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/go-kratos/kratos/v2/middleware"
+	"github.com/go-kratos/kratos/v2/transport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+// HeaderKey is the metadata key callers put their API key in.
+const HeaderKey = "x-api-key"
+
+// exemptPrefixes lists operations that never require an API key.
+var exemptPrefixes = []string{
+	"/grpc.health.v1.",
+	"/grpc.reflection.",
+}
+
+type callerKey struct{}
+
+// NewContext returns a context carrying the authenticated caller label.
+func NewContext(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// FromContext returns the authenticated caller label, if any.
+func FromContext(ctx context.Context) (string, bool) {
+	caller, ok := ctx.Value(callerKey{}).(string)
+	return caller, ok
+}
+
+// Caller returns a log.Valuer that logs the authenticated caller label.
+func Caller() log.Valuer {
+	return func(ctx context.Context) interface{} {
+		caller, _ := FromContext(ctx)
+		return caller
+	}
+}
+
+// Authenticator resolves API keys to caller labels. Keys are configured as hex
+// encoded SHA-256 digests so the plaintext never lives in config files.
+type Authenticator struct {
+	callers map[string]string
+}
+
+// NewAuthenticator returns nil when no keys are configured, which disables
+// authentication.
+func NewAuthenticator(c *conf.Server_Auth) *Authenticator {
+	if len(c.GetKeys()) == 0 {
+		return nil
+	}
+
+	a := &Authenticator{
+		callers: make(map[string]string, len(c.GetKeys())),
+	}
+	for _, k := range c.GetKeys() {
+		a.callers[strings.ToLower(k.GetSha256())] = k.GetName()
+	}
+	return a
+}
+
+// authenticate never includes the key in the returned error.
+func (a *Authenticator) authenticate(operation, key string) (string, error) {
+	for _, prefix := range exemptPrefixes {
+		if strings.HasPrefix(operation, prefix) {
+			return "", nil
+		}
+	}
+
+	if key == "" {
+		return "", pb.ErrorUnauthenticated("missing %s", HeaderKey)
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	caller, ok := a.callers[hex.EncodeToString(sum[:])]
+	if !ok {
+		return "", pb.ErrorUnauthenticated("invalid %s", HeaderKey)
+	}
+	return caller, nil
+}
+
+// Server is a middleware that rejects unary calls without a valid API key.
+func (a *Authenticator) Server() middleware.Middleware {
+	return func(handler middleware.Handler) middleware.Handler {
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			tr, ok := transport.FromServerContext(ctx)
+			if !ok {
+				return nil, pb.ErrorUnauthenticated("missing transport")
+			}
+
+			caller, err := a.authenticate(tr.Operation(), tr.RequestHeader().Get(HeaderKey))
+			if err != nil {
+				return nil, err
+			}
+			if caller != "" {
+				ctx = NewContext(ctx, caller)
+			}
+			return handler(ctx, req)
+		}
+	}
+}
+
+// StreamServer is the streaming counterpart of Server. kratos stream middleware
+// cannot replace the stream context, so this is a plain gRPC interceptor.
+func (a *Authenticator) StreamServer() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		var key string
+		if md, ok := metadata.FromIncomingContext(ss.Context()); ok {
+			if v := md.Get(HeaderKey); len(v) > 0 {
+				key = v[0]
+			}
+		}
+
+		caller, err := a.authenticate(info.FullMethod, key)
+		if err != nil {
+			return err
+		}
+		if caller == "" {
+			return handler(srv, ss)
+		}
+		return handler(srv, &serverStream{
+			ServerStream: ss,
+			ctx:          NewContext(ss.Context(), caller),
+		})
+	}
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-kratos/kratos/v2/transport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+const (
+	testKey       = "proxy-key-alice"
+	listModels    = "/api.proxy.v1.OpenAI/ListModels"
+	streamChat    = "/api.proxy.v1.OpenAI/StreamChatCompletion"
+	healthCheck   = "/grpc.health.v1.Health/Check"
+	reflectionRPC = "/grpc.reflection.v1.ServerReflection/ServerReflectionInfo"
+)
+
+func digest(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func newTestAuthenticator() *Authenticator {
+	return NewAuthenticator(&conf.Server_Auth{Keys: []*conf.Server_Auth_Key{
+		{Name: "alice", Sha256: digest(testKey)},
+		// Digests are matched case-insensitively.
+		{Name: "bob", Sha256: strings.ToUpper(digest("proxy-key-bob"))},
+	}})
+}
+
+type headerCarrier http.Header
+
+func (h headerCarrier) Get(key string) string      { return http.Header(h).Get(key) }
+func (h headerCarrier) Set(key, value string)      { http.Header(h).Set(key, value) }
+func (h headerCarrier) Add(key, value string)      { http.Header(h).Add(key, value) }
+func (h headerCarrier) Keys() []string             { return nil }
+func (h headerCarrier) Values(key string) []string { return http.Header(h).Values(key) }
+
+type fakeTransport struct {
+	operation string
+	header    headerCarrier
+}
+
+func (t *fakeTransport) Kind() transport.Kind            { return transport.KindGRPC }
+func (t *fakeTransport) Endpoint() string                { return "" }
+func (t *fakeTransport) Operation() string               { return t.operation }
+func (t *fakeTransport) RequestHeader() transport.Header { return t.header }
+func (t *fakeTransport) ReplyHeader() transport.Header   { return headerCarrier{} }
+
+var authTests = []struct {
+	name       string
+	operation  string
+	key        string
+	wantCaller string
+	wantErr    bool
+}{
+	{name: "valid key", operation: listModels, key: testKey, wantCaller: "alice"},
+	{name: "second key", operation: listModels, key: "proxy-key-bob", wantCaller: "bob"},
+	{name: "missing key", operation: listModels, wantErr: true},
+	{name: "invalid key", operation: listModels, key: "proxy-key-mallory", wantErr: true},
+	{name: "health check without key", operation: healthCheck},
+	{name: "reflection without key", operation: reflectionRPC},
+}
+
+func TestServer(t *testing.T) {
+	a := newTestAuthenticator()
+	for _, tt := range authTests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &fakeTransport{operation: tt.operation, header: headerCarrier{}}
+			if tt.key != "" {
+				tr.header.Set(HeaderKey, tt.key)
+			}
+			var called bool
+			handler := a.Server()(func(ctx context.Context, req interface{}) (interface{}, error) {
+				called = true
+				caller, _ := FromContext(ctx)
+				if caller != tt.wantCaller {
+					t.Errorf("caller = %q, want %q", caller, tt.wantCaller)
+				}
+				return nil, nil
+			})
+
+			_, err := handler(transport.NewServerContext(context.Background(), tr), nil)
+			checkAuthErr(t, err, tt.key, tt.wantErr)
+			if called == tt.wantErr {
+				t.Fatalf("handler called = %v with err %v", called, err)
+			}
+		})
+	}
+}
+
+func TestServerWithoutTransport(t *testing.T) {
+	handler := newTestAuthenticator().Server()(func(context.Context, interface{}) (interface{}, error) {
+		t.Fatal("handler called without a transport")
+		return nil, nil
+	})
+	if _, err := handler(context.Background(), nil); !pb.IsUnauthenticated(err) {
+		t.Fatalf("err = %v, want UNAUTHENTICATED", err)
+	}
+}
+
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *fakeServerStream) Context() context.Context { return s.ctx }
+
+func TestStreamServer(t *testing.T) {
+	a := newTestAuthenticator()
+	for _, tt := range authTests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.key != "" {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(HeaderKey, tt.key))
+			}
+			operation := tt.operation
+			if operation == listModels {
+				operation = streamChat
+			}
+
+			var called bool
+			err := a.StreamServer()(nil, &fakeServerStream{ctx: ctx}, &grpc.StreamServerInfo{FullMethod: operation},
+				func(srv interface{}, ss grpc.ServerStream) error {
+					called = true
+					caller, _ := FromContext(ss.Context())
+					if caller != tt.wantCaller {
+						t.Errorf("caller = %q, want %q", caller, tt.wantCaller)
+					}
+					return nil
+				})
+			checkAuthErr(t, err, tt.key, tt.wantErr)
+			if called == tt.wantErr {
+				t.Fatalf("handler called = %v with err %v", called, err)
+			}
+		})
+	}
+}
+
+func checkAuthErr(t *testing.T, err error, key string, wantErr bool) {
+	t.Helper()
+	if !wantErr {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	if !pb.IsUnauthenticated(err) {
+		t.Fatalf("err = %v, want UNAUTHENTICATED", err)
+	}
+	if key != "" && strings.Contains(err.Error(), key) {
+		t.Fatalf("error %q leaks the key", err)
+	}
+}
+
+func TestNewAuthenticatorWithoutKeys(t *testing.T) {
+	if a := NewAuthenticator(&conf.Server_Auth{}); a != nil {
+		t.Fatal("authentication enabled without keys")
+	}
+}
+
+func TestCallerValuer(t *testing.T) {
+	if got := Caller()(NewContext(context.Background(), "alice")); got != "alice" {
+		t.Fatalf("got %v, want alice", got)
+	}
+	if got := Caller()(context.Background()); got != "" {
+		t.Fatalf("got %v for an unauthenticated context", got)
+	}
+}
@@ -1,24 +1,39 @@
 package server
 
 import (
+	"time"
+
 	v1 "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/auth"
 	"github.com/wolodata/proxy-service/internal/conf"
 	"github.com/wolodata/proxy-service/internal/service"
 
 	"github.com/go-kratos/kratos/v2/log"
+	"github.com/go-kratos/kratos/v2/middleware"
 	"github.com/go-kratos/kratos/v2/middleware/logging"
 	"github.com/go-kratos/kratos/v2/middleware/recovery"
 	"github.com/go-kratos/kratos/v2/transport/grpc"
+	ggrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
 )
 
 // NewGRPCServer new a gRPC server.
-func NewGRPCServer(c *conf.Server, openai *service.OpenAIService, logger log.Logger) *grpc.Server {
+func NewGRPCServer(c *conf.Server, openai *service.OpenAIService, hp *HealthProber, logger log.Logger) (*grpc.Server, error) {
+	var middlewares = []middleware.Middleware{
+		recovery.Recovery(),
+		logging.Server(logger),
+	}
 	var opts = []grpc.ServerOption{
-		grpc.Middleware(
-			recovery.Recovery(),
-			logging.Server(logger),
-		),
+		grpc.CustomHealth(),
+	}
+	if a := auth.NewAuthenticator(c.Auth); a != nil {
+		middlewares = append(middlewares, a.Server())
+		opts = append(opts, grpc.StreamInterceptor(a.StreamServer()))
+	} else {
+		log.NewHelper(logger).Warn("no API keys configured, gRPC server accepts unauthenticated calls")
 	}
+	opts = append(opts, grpc.Middleware(middlewares...))
 	if c.Grpc.Network != "" {
 		opts = append(opts, grpc.Network(c.Grpc.Network))
 	}
@@ -28,7 +43,86 @@ func NewGRPCServer(c *conf.Server, openai *service.OpenAIService, logger log.Log
 	if c.Grpc.Timeout != nil {
 		opts = append(opts, grpc.Timeout(c.Grpc.Timeout.AsDuration()))
 	}
+	tlsConf, err := newTLSConfig(c.Grpc.Tls)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConf != nil {
+		opts = append(opts, grpc.TLSConfig(tlsConf))
+	}
+	opts = append(opts, grpc.Options(tuningOptions(c.Grpc)...))
 	srv := grpc.NewServer(opts...)
 	v1.RegisterOpenAIServer(srv, openai)
-	return srv
+	grpc_health_v1.RegisterHealthServer(srv, hp.health)
+	return srv, nil
+}
+
+const (
+	defaultKeepaliveTime    = 60 * time.Second
+	defaultKeepaliveTimeout = 20 * time.Second
+	// defaultKeepaliveMinTime is well below grpc-go's five minute default, which
+	// answers clients pinging long-lived streams with GOAWAY.
+	defaultKeepaliveMinTime = 10 * time.Second
+	// defaultMaxMsgSize leaves room above the default max_request_bytes of 10 MB.
+	defaultMaxMsgSize = 16 << 20
+)
+
+// tuning holds the gRPC server transport settings derived from config.
+type tuning struct {
+	keepalive            keepalive.ServerParameters
+	enforcement          keepalive.EnforcementPolicy
+	maxRecvMsgSize       int
+	maxSendMsgSize       int
+	maxConcurrentStreams uint32
+}
+
+// newTuning maps the transport settings of c, filling in defaults suited to
+// long-lived streams.
+func newTuning(c *conf.Server_GRPC) tuning {
+	t := tuning{
+		keepalive: keepalive.ServerParameters{
+			Time:                  defaultKeepaliveTime,
+			Timeout:               defaultKeepaliveTimeout,
+			MaxConnectionAge:      c.GetMaxConnectionAge().AsDuration(),
+			MaxConnectionAgeGrace: c.GetMaxConnectionAgeGrace().AsDuration(),
+		},
+		enforcement: keepalive.EnforcementPolicy{
+			MinTime:             defaultKeepaliveMinTime,
+			PermitWithoutStream: true,
+		},
+		maxRecvMsgSize:       defaultMaxMsgSize,
+		maxSendMsgSize:       defaultMaxMsgSize,
+		maxConcurrentStreams: c.GetMaxConcurrentStreams(),
+	}
+	if c.GetKeepaliveTime().AsDuration() > 0 {
+		t.keepalive.Time = c.GetKeepaliveTime().AsDuration()
+	}
+	if c.GetKeepaliveTimeout().AsDuration() > 0 {
+		t.keepalive.Timeout = c.GetKeepaliveTimeout().AsDuration()
+	}
+	if c.GetKeepaliveMinTime().AsDuration() > 0 {
+		t.enforcement.MinTime = c.GetKeepaliveMinTime().AsDuration()
+	}
+	if c.GetMaxRecvMsgSize() > 0 {
+		t.maxRecvMsgSize = int(c.GetMaxRecvMsgSize())
+	}
+	if c.GetMaxSendMsgSize() > 0 {
+		t.maxSendMsgSize = int(c.GetMaxSendMsgSize())
+	}
+	return t
+}
+
+// tuningOptions maps the transport settings of c onto gRPC server options.
+func tuningOptions(c *conf.Server_GRPC) []ggrpc.ServerOption {
+	t := newTuning(c)
+	opts := []ggrpc.ServerOption{
+		ggrpc.KeepaliveParams(t.keepalive),
+		ggrpc.KeepaliveEnforcementPolicy(t.enforcement),
+		ggrpc.MaxRecvMsgSize(t.maxRecvMsgSize),
+		ggrpc.MaxSendMsgSize(t.maxSendMsgSize),
+	}
+	if t.maxConcurrentStreams > 0 {
+		opts = append(opts, ggrpc.MaxConcurrentStreams(t.maxConcurrentStreams))
+	}
+	return opts
 }
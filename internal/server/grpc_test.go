@@ -0,0 +1,236 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	ggrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	v1 "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/auth"
+	"github.com/wolodata/proxy-service/internal/conf"
+	"github.com/wolodata/proxy-service/internal/service"
+)
+
+const aliceKey = "proxy-key-alice"
+
+// startServer serves the proxy with the transport settings of g on a loopback
+// port with alice's API key and returns a client connection to it.
+func startServer(t *testing.T, g *conf.Server_GRPC, proxy *conf.Proxy) *ggrpc.ClientConn {
+	t.Helper()
+	if g == nil {
+		g = &conf.Server_GRPC{}
+	}
+	g.Addr = "127.0.0.1:0"
+	sum := sha256.Sum256([]byte(aliceKey))
+	c := &conf.Server{
+		Grpc: g,
+		Auth: &conf.Server_Auth{Keys: []*conf.Server_Auth_Key{{Name: "alice", Sha256: hex.EncodeToString(sum[:])}}},
+	}
+	httpClient, err := service.NewHTTPClient(proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	openai := service.NewOpenAIService(proxy, service.NewRuntimeConfig(proxy), httpClient, nil, service.NewQuotaStore(), log.DefaultLogger)
+	hp := NewHealthProber(c, proxy, log.DefaultLogger)
+	hp.setServing(true)
+
+	srv, err := NewGRPCServer(c, openai, hp, log.DefaultLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err := srv.Endpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Start(context.Background())
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+
+	conn, err := ggrpc.NewClient(endpoint.Host, ggrpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func withKey(key string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), auth.HeaderKey, key)
+}
+
+func TestGRPCServerAuth(t *testing.T) {
+	var authorization atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization.Store(r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hello\"}}]}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	conn := startServer(t, nil, &conf.Proxy{
+		Upstream: &conf.Proxy_Upstream{BaseUrl: upstream.URL},
+		Models:   []*conf.Proxy_Model{{Name: "gpt-4o"}},
+		// The vault token is only chosen when the handler sees alice as the caller.
+		Vault: &conf.Proxy_Vault{
+			Tokens:     map[string]string{"alice": "sk-alice"},
+			CallerRefs: map[string]string{"alice": "alice"},
+		},
+	})
+	client := v1.NewOpenAIClient(conn)
+	req := &v1.StreamChatCompletionRequest{
+		Model:    "gpt-4o",
+		Messages: []*v1.ChatCompletionMessage{{Role: v1.ChatCompletionMessageRole_CHAT_COMPLETION_MESSAGE_ROLE_USER, Content: "hi"}},
+	}
+
+	t.Run("unary without key", func(t *testing.T) {
+		_, err := client.ListModels(context.Background(), &v1.ListModelsRequest{})
+		if status.Code(err) != codes.Unauthenticated || !v1.IsUnauthenticated(err) {
+			t.Fatalf("err = %v, want UNAUTHENTICATED", err)
+		}
+	})
+
+	t.Run("stream without key", func(t *testing.T) {
+		stream, err := client.StreamChatCompletion(context.Background(), req)
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		if status.Code(err) != codes.Unauthenticated || !v1.IsUnauthenticated(err) {
+			t.Fatalf("err = %v, want UNAUTHENTICATED", err)
+		}
+		if authorization.Load() != nil {
+			t.Fatal("unauthenticated stream reached the upstream")
+		}
+	})
+
+	t.Run("stream with invalid key", func(t *testing.T) {
+		stream, err := client.StreamChatCompletion(withKey("proxy-key-mallory"), req)
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		if status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("err = %v, want UNAUTHENTICATED", err)
+		}
+	})
+
+	t.Run("health check without key", func(t *testing.T) {
+		resp, err := grpc_health_v1.NewHealthClient(conn).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.GetStatus() != grpc_health_v1.HealthCheckResponse_SERVING {
+			t.Fatalf("status = %v, want SERVING", resp.GetStatus())
+		}
+	})
+
+	t.Run("unary with key", func(t *testing.T) {
+		resp, err := client.ListModels(withKey(aliceKey), &v1.ListModelsRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.GetModels()) != 1 {
+			t.Fatalf("models = %v", resp.GetModels())
+		}
+	})
+
+	t.Run("stream caller reaches handler", func(t *testing.T) {
+		stream, err := client.StreamChatCompletion(withKey(aliceKey), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			if _, err := stream.Recv(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := authorization.Load(); got != "Bearer sk-alice" {
+			t.Fatalf("upstream Authorization = %v, want alice's vault token", got)
+		}
+	})
+}
+
+func TestTuning(t *testing.T) {
+	defaults := tuning{
+		keepalive:      keepalive.ServerParameters{Time: defaultKeepaliveTime, Timeout: defaultKeepaliveTimeout},
+		enforcement:    keepalive.EnforcementPolicy{MinTime: defaultKeepaliveMinTime, PermitWithoutStream: true},
+		maxRecvMsgSize: defaultMaxMsgSize,
+		maxSendMsgSize: defaultMaxMsgSize,
+	}
+	tests := []struct {
+		name string
+		c    *conf.Server_GRPC
+		want tuning
+	}{
+		{name: "nil", want: defaults},
+		{name: "zero values keep defaults", c: &conf.Server_GRPC{KeepaliveTime: durationpb.New(0)}, want: defaults},
+		{
+			name: "configured",
+			c: &conf.Server_GRPC{
+				KeepaliveTime:         durationpb.New(30 * time.Second),
+				KeepaliveTimeout:      durationpb.New(5 * time.Second),
+				KeepaliveMinTime:      durationpb.New(time.Second),
+				MaxConnectionAge:      durationpb.New(time.Hour),
+				MaxConnectionAgeGrace: durationpb.New(10 * time.Minute),
+				MaxConcurrentStreams:  256,
+				MaxRecvMsgSize:        32 << 20,
+				MaxSendMsgSize:        64 << 20,
+			},
+			want: tuning{
+				keepalive: keepalive.ServerParameters{
+					Time:                  30 * time.Second,
+					Timeout:               5 * time.Second,
+					MaxConnectionAge:      time.Hour,
+					MaxConnectionAgeGrace: 10 * time.Minute,
+				},
+				enforcement:          keepalive.EnforcementPolicy{MinTime: time.Second, PermitWithoutStream: true},
+				maxRecvMsgSize:       32 << 20,
+				maxSendMsgSize:       64 << 20,
+				maxConcurrentStreams: 256,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newTuning(tt.c); got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if n := len(tuningOptions(nil)); n != 4 {
+		t.Fatalf("got %d default options, want 4 without a stream limit", n)
+	}
+	if n := len(tuningOptions(&conf.Server_GRPC{MaxConcurrentStreams: 8})); n != 5 {
+		t.Fatalf("got %d options, want 5 with a stream limit", n)
+	}
+}
+
+func TestMaxRecvMsgSizeEnforced(t *testing.T) {
+	conn := startServer(t, &conf.Server_GRPC{MaxRecvMsgSize: 1024}, &conf.Proxy{})
+	_, err := v1.NewOpenAIClient(conn).ChatCompletion(withKey(aliceKey), &v1.ChatCompletionRequest{
+		Model:    "gpt-4o",
+		Messages: []*v1.ChatCompletionMessage{{Role: v1.ChatCompletionMessageRole_CHAT_COMPLETION_MESSAGE_ROLE_USER, Content: strings.Repeat("x", 2048)}},
+	})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("err = %v, want RESOURCE_EXHAUSTED", err)
+	}
+}
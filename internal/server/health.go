@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+
+	v1 "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/conf"
+	"github.com/wolodata/proxy-service/internal/service"
+)
+
+const (
+	defaultProbeInterval         = 10 * time.Second
+	defaultProbeTimeout          = 2 * time.Second
+	defaultProbeFailureThreshold = 3
+)
+
+// HealthProber backs the gRPC health service. It periodically probes the
+// configured upstream URLs, or the upstream base URL when none are configured,
+// and reports the OpenAI service as NOT_SERVING after failureThreshold
+// consecutive failed rounds, and SERVING again after the next successful one.
+// When probing is disabled or there is nothing to probe the service is always
+// SERVING.
+type HealthProber struct {
+	health *health.Server
+	client *http.Client
+
+	urls             []string
+	interval         time.Duration
+	failureThreshold int
+	failures         int
+
+	clock service.Clock
+	done  chan struct{}
+	log   *log.Helper
+}
+
+// HealthOption configures a HealthProber.
+type HealthOption func(*HealthProber)
+
+// WithHealthClock replaces the system clock that paces probe rounds.
+func WithHealthClock(clock service.Clock) HealthOption {
+	return func(p *HealthProber) {
+		p.clock = clock
+	}
+}
+
+func NewHealthProber(c *conf.Server, proxy *conf.Proxy, logger log.Logger, opts ...HealthOption) *HealthProber {
+	p := &HealthProber{
+		health:           health.NewServer(),
+		client:           &http.Client{Timeout: defaultProbeTimeout},
+		interval:         defaultProbeInterval,
+		failureThreshold: defaultProbeFailureThreshold,
+		clock:            service.SystemClock,
+		done:             make(chan struct{}),
+		log:              log.NewHelper(logger),
+	}
+	switch {
+	case c.GetHealth().GetDisabled():
+	case len(c.GetHealth().GetUrls()) > 0:
+		p.urls = c.GetHealth().GetUrls()
+	case proxy.GetUpstream().GetBaseUrl() != "":
+		p.urls = []string{proxy.GetUpstream().GetBaseUrl()}
+	}
+	if c.GetHealth().GetInterval().AsDuration() > 0 {
+		p.interval = c.GetHealth().GetInterval().AsDuration()
+	}
+	if c.GetHealth().GetTimeout().AsDuration() > 0 {
+		p.client.Timeout = c.GetHealth().GetTimeout().AsDuration()
+	}
+	if c.GetHealth().GetFailureThreshold() > 0 {
+		p.failureThreshold = int(c.GetHealth().GetFailureThreshold())
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Start marks the server as serving and runs the probe loop until Stop.
+func (p *HealthProber) Start(ctx context.Context) error {
+	p.setServing(true)
+	if len(p.urls) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-p.done
+		cancel()
+	}()
+
+	ticker := p.clock.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		p.probe(ctx)
+		select {
+		case <-ticker.C():
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Stop reports every service as NOT_SERVING so clients drain before shutdown.
+func (p *HealthProber) Stop(context.Context) error {
+	close(p.done)
+	p.health.Shutdown()
+	return nil
+}
+
+// probe runs one round against every URL. Any HTTP response below 500 counts as
+// reachable; a base URL answering 404 to HEAD is still up.
+func (p *HealthProber) probe(ctx context.Context) {
+	for _, url := range p.urls {
+		if err := p.head(ctx, url); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			p.failures++
+			p.log.Warnf("health probe %s failed (%d/%d): %v", url, p.failures, p.failureThreshold, err)
+			if p.failures >= p.failureThreshold {
+				p.setServing(false)
+			}
+			return
+		}
+	}
+
+	if p.failures >= p.failureThreshold {
+		p.log.Infof("health probes recovered after %d failures", p.failures)
+	}
+	p.failures = 0
+	p.setServing(true)
+}
+
+func (p *HealthProber) head(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (p *HealthProber) setServing(serving bool) {
+	status := grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	if serving {
+		status = grpc_health_v1.HealthCheckResponse_SERVING
+	}
+	p.health.SetServingStatus("", status)
+	p.health.SetServingStatus(v1.OpenAI_ServiceDesc.ServiceName, status)
+}
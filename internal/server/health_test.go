@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"google.golang.org/grpc/health/grpc_health_v1"
+
+	v1 "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+func TestNewHealthProberURLs(t *testing.T) {
+	proxy := &conf.Proxy{Upstream: &conf.Proxy_Upstream{BaseUrl: "https://api.example.com/v1"}}
+	tests := []struct {
+		name   string
+		health *conf.Server_Health
+		proxy  *conf.Proxy
+		want   []string
+	}{
+		{name: "base url by default", proxy: proxy, want: []string{"https://api.example.com/v1"}},
+		{name: "configured urls win", health: &conf.Server_Health{Urls: []string{"https://status.example.com"}}, proxy: proxy, want: []string{"https://status.example.com"}},
+		{name: "disabled", health: &conf.Server_Health{Disabled: true}, proxy: proxy},
+		{name: "nothing to probe", proxy: &conf.Proxy{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewHealthProber(&conf.Server{Health: tt.health}, tt.proxy, log.DefaultLogger)
+			if !reflect.DeepEqual(p.urls, tt.want) {
+				t.Fatalf("urls = %v, want %v", p.urls, tt.want)
+			}
+		})
+	}
+}
+
+func servingStatus(t *testing.T, p *HealthProber) grpc_health_v1.HealthCheckResponse_ServingStatus {
+	t.Helper()
+	resp, err := p.health.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{Service: v1.OpenAI_ServiceDesc.ServiceName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.GetStatus()
+}
+
+func TestHealthProberStateMachine(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusNotFound)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			t.Errorf("probe method = %s, want HEAD", r.Method)
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer upstream.Close()
+
+	p := NewHealthProber(
+		&conf.Server{Health: &conf.Server_Health{FailureThreshold: 2}},
+		&conf.Proxy{Upstream: &conf.Proxy_Upstream{BaseUrl: upstream.URL}},
+		log.DefaultLogger,
+	)
+	const (
+		serving    = grpc_health_v1.HealthCheckResponse_SERVING
+		notServing = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	)
+	steps := []struct {
+		status int
+		want   grpc_health_v1.HealthCheckResponse_ServingStatus
+	}{
+		{http.StatusNotFound, serving}, // a base URL without a HEAD route is up
+		{http.StatusBadGateway, serving},
+		{http.StatusBadGateway, notServing},
+		{http.StatusServiceUnavailable, notServing},
+		{http.StatusOK, serving},
+		{http.StatusBadGateway, serving}, // recovery reset the failure count
+		{http.StatusOK, serving},
+	}
+	for i, step := range steps {
+		status.Store(int32(step.status))
+		p.probe(context.Background())
+		if got := servingStatus(t, p); got != step.want {
+			t.Fatalf("step %d (upstream %d): status = %v, want %v", i, step.status, got, step.want)
+		}
+	}
+
+	upstream.Close()
+	p.probe(context.Background())
+	p.probe(context.Background())
+	if got := servingStatus(t, p); got != notServing {
+		t.Fatalf("unreachable upstream: status = %v, want NOT_SERVING", got)
+	}
+}
+
+func TestHealthProberStartStop(t *testing.T) {
+	var probes atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+	}))
+	defer upstream.Close()
+
+	p := NewHealthProber(&conf.Server{}, &conf.Proxy{Upstream: &conf.Proxy_Upstream{BaseUrl: upstream.URL}}, log.DefaultLogger)
+	done := make(chan error, 1)
+	go func() { done <- p.Start(context.Background()) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for probes.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("base url not probed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := servingStatus(t, p); got != grpc_health_v1.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("status after Stop = %v, want NOT_SERVING", got)
+	}
+}
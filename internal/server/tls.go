@@ -0,0 +1,134 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+// newTLSConfig builds the listener TLS config, or returns nil when no
+// certificate is configured. The key pair and the client CA bundle are
+// reloaded when their files change, so rotation does not need a restart.
+func newTLSConfig(c *conf.Server_TLS) (*tls.Config, error) {
+	if c.GetCertFile() == "" && c.GetKeyFile() == "" {
+		return nil, nil
+	}
+
+	r := &certReloader{certFile: c.GetCertFile(), keyFile: c.GetKeyFile(), caFile: c.GetCaFile()}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.getCertificate,
+	}
+	switch c.GetClientAuth() {
+	case conf.Server_TLS_REQUEST:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case conf.Server_TLS_REQUIRE:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if cfg.ClientAuth != tls.NoClientCert && r.clientCAs == nil {
+		return nil, fmt.Errorf("client_auth %s requires ca_file", c.GetClientAuth())
+	}
+	if r.clientCAs != nil {
+		cfg.ClientCAs = r.clientCAs
+		// ClientCAs is read once per handshake from the config in use, so hand
+		// each handshake a copy carrying the current bundle.
+		cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.reloadIfChanged()
+			hello := cfg.Clone()
+			hello.GetConfigForClient = nil
+			r.mu.Lock()
+			hello.ClientCAs = r.clientCAs
+			r.mu.Unlock()
+			return hello, nil
+		}
+	}
+	return cfg, nil
+}
+
+// certReloader serves the key pair and client CA bundle from disk, reloading
+// them when any file's modification time changes. Failed reloads keep serving
+// the previous pair and bundle.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTime   time.Time
+}
+
+func (r *certReloader) reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load key pair: %w", err)
+	}
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("read ca_file: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in ca_file %s", r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCAs = pool
+	r.modTime = modTime
+	return nil
+}
+
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile, r.caFile} {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) reloadIfChanged() {
+	r.mu.Lock()
+	modTime := r.modTime
+	r.mu.Unlock()
+
+	if latest, err := r.latestModTime(); err == nil && latest.After(modTime) {
+		// Ignore the error; half-written files are picked up on the next handshake.
+		_ = r.reload()
+	}
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.reloadIfChanged()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
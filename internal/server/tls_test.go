@@ -0,0 +1,289 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	tls  tls.Certificate
+}
+
+// newCert issues a certificate for name signed by parent, or a self-signed CA
+// when parent is nil.
+func newCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, tls: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}}
+}
+
+func (c *testCert) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.cert)
+	return pool
+}
+
+// write stores the certificate and key PEM files, dating them at modTime so
+// reloads are detected regardless of file system timestamp resolution.
+func (c *testCert) write(t *testing.T, certFile, keyFile string, modTime time.Time) {
+	t.Helper()
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, certFile, "CERTIFICATE", c.cert.Raw, modTime)
+	if keyFile != "" {
+		writePEM(t, keyFile, "EC PRIVATE KEY", der, modTime)
+	}
+}
+
+func writePEM(t *testing.T, name, typ string, der []byte, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// handshake connects client to a listener using server and returns the common
+// name the server presented and the server side handshake error.
+func handshake(t *testing.T, server, client *tls.Config) (string, error) {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		serverErr <- conn.(*tls.Conn).Handshake()
+	}()
+
+	client = client.Clone()
+	client.ServerName = "localhost"
+	conn, err := tls.Dial("tcp", ln.Addr().String(), client)
+	if err != nil {
+		if serr := <-serverErr; serr != nil {
+			return "", serr
+		}
+		t.Fatalf("client handshake: %v", err)
+	}
+	defer conn.Close()
+	// A rejected client certificate only surfaces on the server under TLS 1.3.
+	if err := <-serverErr; err != nil {
+		return "", err
+	}
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+}
+
+type tlsFiles struct {
+	cert, key, ca string
+}
+
+func newTLSFiles(t *testing.T) tlsFiles {
+	dir := t.TempDir()
+	return tlsFiles{
+		cert: filepath.Join(dir, "server.crt"),
+		key:  filepath.Join(dir, "server.key"),
+		ca:   filepath.Join(dir, "ca.crt"),
+	}
+}
+
+func TestTLSConfigSelfSigned(t *testing.T) {
+	files := newTLSFiles(t)
+	server := newCert(t, "localhost", nil)
+	server.write(t, files.cert, files.key, time.Now())
+
+	cfg, err := newTLSConfig(&conf.Server_TLS{CertFile: files.cert, KeyFile: files.key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn, err := handshake(t, cfg, &tls.Config{RootCAs: server.pool()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn != "localhost" {
+		t.Fatalf("server presented %q", cn)
+	}
+}
+
+func TestTLSConfigNoCertificate(t *testing.T) {
+	cfg, err := newTLSConfig(&conf.Server_TLS{})
+	if err != nil || cfg != nil {
+		t.Fatalf("got %v, %v; want plaintext", cfg, err)
+	}
+}
+
+func TestTLSConfigClientAuthRequiresCA(t *testing.T) {
+	files := newTLSFiles(t)
+	newCert(t, "localhost", nil).write(t, files.cert, files.key, time.Now())
+
+	_, err := newTLSConfig(&conf.Server_TLS{CertFile: files.cert, KeyFile: files.key, ClientAuth: conf.Server_TLS_REQUIRE})
+	if err == nil {
+		t.Fatal("REQUIRE without ca_file accepted")
+	}
+}
+
+func TestTLSConfigRequireClientCert(t *testing.T) {
+	files := newTLSFiles(t)
+	ca := newCert(t, "proxy-ca", nil)
+	ca.write(t, files.ca, "", time.Now())
+	newCert(t, "localhost", ca).write(t, files.cert, files.key, time.Now())
+	alice := newCert(t, "alice", ca)
+	stranger := newCert(t, "stranger", newCert(t, "other-ca", nil))
+
+	for _, mode := range []conf.Server_TLS_ClientAuth{conf.Server_TLS_REQUIRE, conf.Server_TLS_REQUEST} {
+		t.Run(mode.String(), func(t *testing.T) {
+			cfg, err := newTLSConfig(&conf.Server_TLS{CertFile: files.cert, KeyFile: files.key, CaFile: files.ca, ClientAuth: mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &tls.Config{RootCAs: ca.pool()}
+
+			_, err = handshake(t, cfg, client)
+			if mode == conf.Server_TLS_REQUIRE && err == nil {
+				t.Fatal("client without a certificate accepted")
+			}
+			if mode == conf.Server_TLS_REQUEST && err != nil {
+				t.Fatalf("client without a certificate rejected: %v", err)
+			}
+
+			// Force the certificate out; the client would otherwise withhold
+			// one the server's CA list does not name.
+			client.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &stranger.tls, nil
+			}
+			if _, err := handshake(t, cfg, client); err == nil {
+				t.Fatal("certificate from an unknown CA accepted")
+			}
+
+			client.GetClientCertificate = nil
+			client.Certificates = []tls.Certificate{alice.tls}
+			if _, err := handshake(t, cfg, client); err != nil {
+				t.Fatalf("client certificate rejected: %v", err)
+			}
+		})
+	}
+}
+
+func TestTLSConfigReload(t *testing.T) {
+	files := newTLSFiles(t)
+	oldCA, newCA := newCert(t, "old-ca", nil), newCert(t, "new-ca", nil)
+	start := time.Now().Add(-time.Minute)
+	oldCA.write(t, files.ca, "", start)
+	newCert(t, "localhost", oldCA).write(t, files.cert, files.key, start)
+
+	cfg, err := newTLSConfig(&conf.Server_TLS{CertFile: files.cert, KeyFile: files.key, CaFile: files.ca, ClientAuth: conf.Server_TLS_REQUIRE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(oldCA.cert)
+	roots.AddCert(newCA.cert)
+	oldClient := &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{newCert(t, "old-client", oldCA).tls}}
+	newClient := &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{newCert(t, "new-client", newCA).tls}}
+
+	if _, err := handshake(t, cfg, oldClient); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := newCert(t, "localhost", newCA)
+	rotated.write(t, files.cert, files.key, time.Now())
+	newCA.write(t, files.ca, "", time.Now())
+
+	if _, err := handshake(t, cfg, oldClient); err == nil {
+		t.Fatal("client of the replaced CA still accepted")
+	}
+	if _, err := handshake(t, cfg, newClient); err != nil {
+		t.Fatalf("client of the new CA rejected: %v", err)
+	}
+	conn, err := tls.Dial("tcp", listenTLS(t, cfg), &tls.Config{RootCAs: newCA.pool(), ServerName: "localhost", Certificates: newClient.Certificates})
+	if err != nil {
+		t.Fatalf("rotated server certificate not served: %v", err)
+	}
+	defer conn.Close()
+	if got := conn.ConnectionState().PeerCertificates[0].SerialNumber; got.Cmp(rotated.cert.SerialNumber) != 0 {
+		t.Fatalf("server serial = %v, want the rotated %v", got, rotated.cert.SerialNumber)
+	}
+
+	// A broken rewrite keeps serving the last good files.
+	writePEM(t, files.ca, "CERTIFICATE", []byte("garbage"), time.Now().Add(time.Minute))
+	if _, err := handshake(t, cfg, newClient); err != nil {
+		t.Fatalf("broken ca_file replaced the previous bundle: %v", err)
+	}
+}
+
+// listenTLS serves handshakes on a loopback port until the test ends.
+func listenTLS(t *testing.T, cfg *tls.Config) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/errors"
+	"github.com/go-kratos/kratos/v2/log"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+)
+
+// accessLog samples the per-stream access log: every failed stream is logged,
+// successful ones only one in sampleRate.
+type accessLog struct {
+	n atomic.Uint64
+}
+
+func (a *accessLog) sample(err error, sampleRate uint64) bool {
+	if err != nil || sampleRate <= 1 {
+		return true
+	}
+	return a.n.Add(1)%sampleRate == 0
+}
+
+// streamStats wraps a stream to record what was sent to the client.
+type streamStats struct {
+	pb.OpenAI_StreamChatCompletionServer
+
+	clock      Clock
+	start      time.Time
+	model      string
+	chunks     atomic.Int64
+	bytes      int
+	firstChunk time.Duration
+	usage      *pb.Usage
+	upstream   *upstreamResponse
+}
+
+func (s *streamStats) Send(res *pb.StreamChatCompletionResponse) error {
+	if err := s.OpenAI_StreamChatCompletionServer.Send(res); err != nil {
+		return err
+	}
+	if s.chunks.Add(1) == 1 {
+		s.firstChunk = s.clock.Now().Sub(s.start)
+	}
+	s.bytes += len(res.GetChunk())
+	s.model = res.GetModel()
+	if res.GetUsage() != nil {
+		s.usage = res.GetUsage()
+	}
+	return nil
+}
+
+// logStream emits one structured access log line for a finished stream.
+func (s *OpenAIService) logStream(req *pb.StreamChatCompletionRequest, stats *streamStats, err error) {
+	if !s.accessLog.sample(err, s.rt.load().sampleRate) {
+		return
+	}
+
+	level, reason := log.LevelInfo, ""
+	if se := errors.FromError(err); se != nil {
+		level, reason = log.LevelError, se.Reason
+	}
+	s.log.WithContext(stats.Context()).Log(level,
+		"msg", "stream access",
+		"requested_model", req.GetModel(),
+		"model", stats.model,
+		"messages", len(req.GetMessages()),
+		"chunks", stats.chunks.Load(),
+		"bytes", stats.bytes,
+		"first_chunk", stats.firstChunk.Seconds(),
+		"duration", s.clock.Now().Sub(stats.start).Seconds(),
+		"prompt_tokens", stats.usage.GetPromptTokens(),
+		"completion_tokens", stats.usage.GetCompletionTokens(),
+		"upstream_status", stats.upstream.statusCode(),
+		"reason", reason,
+	)
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+// captureLogger records the lines with message msg logged through it.
+type captureLogger struct {
+	msg string
+
+	mu    sync.Mutex
+	lines []map[string]any
+}
+
+func (l *captureLogger) Log(level log.Level, keyvals ...any) error {
+	line := map[string]any{"level": level}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		line[keyvals[i].(string)] = keyvals[i+1]
+	}
+	if line["msg"] == l.msg {
+		l.mu.Lock()
+		l.lines = append(l.lines, line)
+		l.mu.Unlock()
+	}
+	return nil
+}
+
+func (l *captureLogger) captured() []map[string]any {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]map[string]any(nil), l.lines...)
+}
+
+func TestLogStream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer sk-bad" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"message":"bad request"}}`))
+			return
+		}
+		writeSSE(w, "gpt-4o", "hello")
+	}))
+	defer upstream.Close()
+
+	c := &conf.Proxy{AccessLog: &conf.Proxy_AccessLog{SampleRate: 3}}
+	httpClient, err := NewHTTPClient(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := &captureLogger{msg: "stream access"}
+	s := NewOpenAIService(c, NewRuntimeConfig(c), httpClient, nil, NewQuotaStore(), logs)
+
+	for i := 0; i < 6; i++ {
+		if err := s.StreamChatCompletion(streamRequest(upstream.URL, "gpt-4o"), newFakeStream(context.Background())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := logs.captured()
+	if len(lines) != 2 {
+		t.Fatalf("logged %d of 6 successful streams, want 2 at sample_rate 3", len(lines))
+	}
+	want := map[string]any{
+		"level":             log.LevelInfo,
+		"requested_model":   "gpt-4o",
+		"model":             "gpt-4o",
+		"messages":          1,
+		"bytes":             len("hello"),
+		"prompt_tokens":     int64(1),
+		"completion_tokens": int64(1),
+		"upstream_status":   http.StatusOK,
+		"reason":            "",
+	}
+	for k, v := range want {
+		if lines[0][k] != v {
+			t.Errorf("%s = %v (%T), want %v (%T)", k, lines[0][k], lines[0][k], v, v)
+		}
+	}
+	if n, _ := lines[0]["chunks"].(int64); n == 0 {
+		t.Errorf("chunks = %v", lines[0]["chunks"])
+	}
+	for _, k := range []string{"first_chunk", "duration"} {
+		if _, ok := lines[0][k].(float64); !ok {
+			t.Errorf("%s = %v, want seconds", k, lines[0][k])
+		}
+	}
+
+	// Failed streams bypass sampling.
+	req := streamRequest(upstream.URL, "gpt-4o")
+	req.Token = "sk-bad"
+	err = s.StreamChatCompletion(req, newFakeStream(context.Background()))
+	if err == nil {
+		t.Fatal("expected the upstream error")
+	}
+	lines = logs.captured()
+	if len(lines) != 3 {
+		t.Fatalf("failed stream not logged, %d lines", len(lines))
+	}
+	failed := lines[2]
+	if failed["level"] != log.LevelError || failed["upstream_status"] != http.StatusBadRequest || failed["reason"] == "" {
+		t.Fatalf("failed stream logged as %v", failed)
+	}
+}
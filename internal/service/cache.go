@@ -0,0 +1,115 @@
+package service
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+// responseCache is an LRU cache of unary responses with a TTL. A nil cache is
+// disabled. Only successful responses are stored.
+type responseCache struct {
+	maxEntries int
+	ttl        time.Duration
+	clock      Clock
+
+	mu      sync.Mutex
+	ll      *list.List
+	entries map[[sha256.Size]byte]*list.Element
+}
+
+type cacheEntry struct {
+	key     [sha256.Size]byte
+	res     *pb.ChatCompletionResponse
+	expires time.Time
+}
+
+func newResponseCache(c *conf.Proxy_Cache, clock Clock) *responseCache {
+	if c.GetMaxEntries() <= 0 {
+		return nil
+	}
+	return &responseCache{
+		maxEntries: int(c.GetMaxEntries()),
+		ttl:        c.GetTtl().AsDuration(),
+		clock:      clock,
+		ll:         list.New(),
+		entries:    make(map[[sha256.Size]byte]*list.Element),
+	}
+}
+
+// cacheKey hashes everything that shapes the upstream answer, scoped to the
+// authenticated caller and the resolved upstream token. Entries are never
+// shared across tenants or credentials, so a hit neither reveals another
+// caller's conversation nor serves answers paid for by another key.
+func cacheKey(req *pb.ChatCompletionRequest, caller, token string) [sha256.Size]byte {
+	req = proto.Clone(req).(*pb.ChatCompletionRequest)
+	req.Token = ""
+	req.TokenRef = ""
+	b, _ := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+
+	h := sha256.New()
+	for _, part := range [][]byte{b, []byte(caller), []byte(token)} {
+		// Length prefixes keep the boundaries between parts unambiguous.
+		h.Write(binary.AppendUvarint(nil, uint64(len(part))))
+		h.Write(part)
+	}
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key
+}
+
+func (c *responseCache) get(key [sha256.Size]byte) (*pb.ChatCompletionResponse, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if c.ttl > 0 && c.clock.Now().After(e.expires) {
+		c.ll.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+
+	res := proto.Clone(e.res).(*pb.ChatCompletionResponse)
+	res.Cached = true
+	return res, true
+}
+
+func (c *responseCache) add(key [sha256.Size]byte, res *pb.ChatCompletionResponse) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := &cacheEntry{
+		key:     key,
+		res:     proto.Clone(res).(*pb.ChatCompletionResponse),
+		expires: c.clock.Now().Add(c.ttl),
+	}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.ll.PushFront(e)
+	if c.ll.Len() > c.maxEntries {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -0,0 +1,179 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/auth"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+func cacheRequest(content string) *pb.ChatCompletionRequest {
+	return &pb.ChatCompletionRequest{
+		Model:    "gpt-4o",
+		Messages: userMessages(content),
+	}
+}
+
+func TestResponseCacheHitMissExpiry(t *testing.T) {
+	clock := newFakeClock()
+	c := newResponseCache(&conf.Proxy_Cache{MaxEntries: 2, Ttl: durationpb.New(time.Minute)}, clock)
+	key := cacheKey(cacheRequest("hi"), "alice", "sk-1")
+
+	if _, ok := c.get(key); ok {
+		t.Fatal("hit on an empty cache")
+	}
+	c.add(key, &pb.ChatCompletionResponse{Content: "hello"})
+
+	res, ok := c.get(key)
+	if !ok || res.GetContent() != "hello" || !res.GetCached() {
+		t.Fatalf("got %v, %v; want a cached hello", res, ok)
+	}
+	res.Content = "mutated"
+	if res, _ := c.get(key); res.GetContent() != "hello" {
+		t.Fatal("caller mutation leaked into the cache")
+	}
+
+	clock.Advance(time.Minute)
+	if _, ok := c.get(key); !ok {
+		t.Fatal("entry expired at exactly its ttl")
+	}
+	clock.Advance(time.Nanosecond)
+	if _, ok := c.get(key); ok {
+		t.Fatal("hit after the ttl elapsed")
+	}
+	if len(c.entries) != 0 || c.ll.Len() != 0 {
+		t.Fatal("expired entry was not dropped")
+	}
+}
+
+func TestResponseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newResponseCache(&conf.Proxy_Cache{MaxEntries: 2}, newFakeClock())
+	a := cacheKey(cacheRequest("a"), "", "")
+	b := cacheKey(cacheRequest("b"), "", "")
+	d := cacheKey(cacheRequest("d"), "", "")
+
+	c.add(a, &pb.ChatCompletionResponse{Content: "a"})
+	c.add(b, &pb.ChatCompletionResponse{Content: "b"})
+	c.get(a)
+	c.add(d, &pb.ChatCompletionResponse{Content: "d"})
+
+	if _, ok := c.get(b); ok {
+		t.Fatal("least recently used entry was not evicted")
+	}
+	for _, key := range [][32]byte{a, d} {
+		if _, ok := c.get(key); !ok {
+			t.Fatal("recently used entry was evicted")
+		}
+	}
+}
+
+func TestResponseCacheDisabled(t *testing.T) {
+	c := newResponseCache(&conf.Proxy_Cache{}, newFakeClock())
+	key := cacheKey(cacheRequest("hi"), "", "")
+	c.add(key, &pb.ChatCompletionResponse{Content: "hello"})
+	if _, ok := c.get(key); ok {
+		t.Fatal("disabled cache returned a hit")
+	}
+}
+
+func TestCacheKeyScope(t *testing.T) {
+	base := cacheKey(cacheRequest("hi"), "alice", "sk-1")
+
+	withRef := cacheRequest("hi")
+	withRef.TokenRef = "team"
+	if cacheKey(withRef, "alice", "sk-1") != base {
+		t.Fatal("key depends on how the token was named rather than which token resolved")
+	}
+
+	for name, key := range map[string][32]byte{
+		"message": cacheKey(cacheRequest("bye"), "alice", "sk-1"),
+		"caller":  cacheKey(cacheRequest("hi"), "bob", "sk-1"),
+		"token":   cacheKey(cacheRequest("hi"), "alice", "sk-2"),
+		// Moving bytes between caller and token must not collide.
+		"boundary": cacheKey(cacheRequest("hi"), "alicesk-", "1"),
+	} {
+		if key == base {
+			t.Errorf("different %s produced the same key", name)
+		}
+	}
+}
+
+func TestResponseCacheConcurrentAccess(t *testing.T) {
+	c := newResponseCache(&conf.Proxy_Cache{MaxEntries: 16, Ttl: durationpb.New(time.Minute)}, newFakeClock())
+
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				content := fmt.Sprint((w + i) % 32)
+				key := cacheKey(cacheRequest(content), "", "")
+				if res, ok := c.get(key); ok && res.GetContent() != content {
+					t.Errorf("key for %q returned %q", content, res.GetContent())
+				}
+				c.add(key, &pb.ChatCompletionResponse{Content: content})
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if c.ll.Len() > 16 || len(c.entries) != c.ll.Len() {
+		t.Fatalf("cache holds %d list and %d map entries, max 16", c.ll.Len(), len(c.entries))
+	}
+}
+
+func TestChatCompletionCache(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":{"message":"bad request"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"model":"gpt-4o","choices":[{"message":{"role":"assistant","content":"hello"}}],"usage":{"total_tokens":2}}`)
+	}))
+	defer upstream.Close()
+
+	s := newTestService(t, &conf.Proxy{Cache: &conf.Proxy_Cache{MaxEntries: 8}})
+	req := cacheRequest("hi")
+	req.Url = upstream.URL
+	alice := auth.NewContext(context.Background(), "alice")
+
+	if _, err := s.ChatCompletion(alice, req); err == nil {
+		t.Fatal("expected the upstream error")
+	}
+	res, err := s.ChatCompletion(alice, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.GetCached() {
+		t.Fatal("failed response was cached")
+	}
+	res, err = s.ChatCompletion(alice, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.GetCached() || res.GetContent() != "hello" {
+		t.Fatalf("got %v, want a cached hello", res)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("upstream called %d times, want 2", n)
+	}
+
+	bob := auth.NewContext(context.Background(), "bob")
+	if res, err := s.ChatCompletion(bob, req); err != nil || res.GetCached() {
+		t.Fatalf("another caller got %v, %v; want a fresh response", res, err)
+	}
+}
@@ -0,0 +1,189 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/errors"
+	openai "github.com/sashabaranov/go-openai"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 32
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultConnectTimeout      = 30 * time.Second
+	defaultMaxResponseBytes    = 64 << 20
+)
+
+// NewHTTPClient builds the HTTP client shared by all upstream calls. The stdlib
+// default of two idle connections per host causes connection churn when many
+// streams hit the same upstream concurrently.
+func NewHTTPClient(proxy *conf.Proxy) (*http.Client, error) {
+	c := proxy.GetUpstream()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = newDialer(c).DialContext
+	transport.ResponseHeaderTimeout = c.GetResponseHeaderTimeout().AsDuration()
+	transport.MaxIdleConns = defaultMaxIdleConns
+	transport.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	transport.IdleConnTimeout = defaultIdleConnTimeout
+
+	if c.GetMaxIdleConns() > 0 {
+		transport.MaxIdleConns = int(c.GetMaxIdleConns())
+	}
+	if c.GetMaxIdleConnsPerHost() > 0 {
+		transport.MaxIdleConnsPerHost = int(c.GetMaxIdleConnsPerHost())
+	}
+	if c.GetIdleConnTimeout().AsDuration() > 0 {
+		transport.IdleConnTimeout = c.GetIdleConnTimeout().AsDuration()
+	}
+	if c.GetProxyUrl() != "" {
+		u, err := url.Parse(c.GetProxyUrl())
+		if err != nil {
+			return nil, fmt.Errorf("parse upstream proxy_url: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+
+	maxResponseBytes := int64(defaultMaxResponseBytes)
+	if c.GetMaxResponseBytes() > 0 {
+		maxResponseBytes = c.GetMaxResponseBytes()
+	}
+
+	return &http.Client{Transport: recordingTransport{base: extraParamsTransport{base: limitTransport{
+		base:     transport,
+		maxBytes: maxResponseBytes,
+	}}}}, nil
+}
+
+// newDialer returns the dialer for upstream connections.
+func newDialer(c *conf.Proxy_Upstream) *net.Dialer {
+	connectTimeout := defaultConnectTimeout
+	if c.GetConnectTimeout().AsDuration() > 0 {
+		connectTimeout = c.GetConnectTimeout().AsDuration()
+	}
+	return &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+}
+
+// newClient creates an OpenAI client for the caller supplied endpoint and token,
+// falling back to the configured base URL.
+func (s *OpenAIService) newClient(baseURL, token string) *openai.Client {
+	cfg := openai.DefaultConfig(token)
+	if baseURL == "" {
+		baseURL = s.baseURL
+	}
+	if baseURL != "" {
+		cfg.BaseURL = baseURL
+	}
+	cfg.HTTPClient = s.httpClient
+
+	return openai.NewClientWithConfig(cfg)
+}
+
+// withUpstreamTimeout bounds ctx by the configured upstream timeout, so a slow
+// upstream is aborted while the client connection stays usable for the error.
+func (s *OpenAIService) withUpstreamTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.upstreamTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return withTimeoutCause(ctx, s.clock, s.upstreamTimeout,
+		pb.ErrorUpstreamTimeout("upstream did not complete within %s", s.upstreamTimeout))
+}
+
+// withFallback calls fn with each model in turn, retrying each up to the
+// configured count, until one succeeds or fails with an error that is not worth
+// retrying. Retries and fallbacks share one attempt and elapsed-time budget;
+// once it is spent the last error is returned. It returns the model that served
+// the request.
+func (s *OpenAIService) withFallback(ctx context.Context, models []string, fn func(model string) error) (string, error) {
+	var (
+		err      error
+		attempts int
+		start    = s.clock.Now()
+		retry    = s.rt.load().retry
+	)
+	for i, model := range models {
+		for try := 0; try <= int(retry.GetPerModel()); try++ {
+			if attempts > 0 && s.budgetSpent(retry, attempts, start) {
+				s.log.WithContext(ctx).Warnf("retry budget spent after %d attempts in %s", attempts, s.clock.Now().Sub(start))
+				return "", err
+			}
+			if try > 0 {
+				s.log.WithContext(ctx).Warnf("model %s failed, retrying: %v", model, err)
+				if werr := s.sleep(ctx, retry.GetBackoff().AsDuration()); werr != nil {
+					return "", err
+				}
+			}
+
+			attempts++
+			err = fn(model)
+			if err == nil {
+				if i > 0 {
+					s.log.WithContext(ctx).Infof("request served by fallback model %s", model)
+				}
+				return model, nil
+			}
+			if !isRetryable(err) {
+				return "", err
+			}
+		}
+		if i < len(models)-1 {
+			s.log.WithContext(ctx).Warnf("model %s failed, falling back to %s: %v", model, models[i+1], err)
+		}
+	}
+	return "", err
+}
+
+// budgetSpent reports whether the shared retry budget is exhausted. Zero limits
+// are unlimited.
+func (s *OpenAIService) budgetSpent(retry *conf.Proxy_Retry, attempts int, start time.Time) bool {
+	if n := int(retry.GetMaxAttempts()); n > 0 && attempts >= n {
+		return true
+	}
+	if d := retry.GetMaxElapsed().AsDuration(); d > 0 && s.clock.Now().Sub(start) >= d {
+		return true
+	}
+	return false
+}
+
+// sleep waits for d or until ctx is done.
+func (s *OpenAIService) sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	select {
+	case <-s.clock.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isRetryable reports whether err is an upstream rate limit or server error.
+func isRetryable(err error) bool {
+	var status int
+
+	var apiErr *openai.APIError
+	var reqErr *openai.RequestError
+	switch {
+	case errors.As(err, &apiErr):
+		status = apiErr.HTTPStatusCode
+	case errors.As(err, &reqErr):
+		status = reqErr.HTTPStatusCode
+	default:
+		return false
+	}
+
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
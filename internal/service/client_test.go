@@ -0,0 +1,355 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/config"
+	"github.com/go-kratos/kratos/v2/config/file"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+// baseTransport unwraps the transport chain NewHTTPClient builds.
+func baseTransport(t *testing.T, upstream *conf.Proxy_Upstream) (*http.Transport, limitTransport) {
+	t.Helper()
+	client, err := NewHTTPClient(&conf.Proxy{Upstream: upstream})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := client.Transport.(recordingTransport).base.(extraParamsTransport).base.(limitTransport)
+	return limit.base.(*http.Transport), limit
+}
+
+func TestNewHTTPClientIdleConns(t *testing.T) {
+	tests := []struct {
+		name                    string
+		upstream                *conf.Proxy_Upstream
+		maxIdle, maxIdlePerHost int
+		idleTimeout             time.Duration
+	}{
+		{name: "defaults", maxIdle: defaultMaxIdleConns, maxIdlePerHost: defaultMaxIdleConnsPerHost, idleTimeout: defaultIdleConnTimeout},
+		{name: "zero values keep defaults", upstream: &conf.Proxy_Upstream{IdleConnTimeout: durationpb.New(0)}, maxIdle: defaultMaxIdleConns, maxIdlePerHost: defaultMaxIdleConnsPerHost, idleTimeout: defaultIdleConnTimeout},
+		{
+			name:           "configured",
+			upstream:       &conf.Proxy_Upstream{MaxIdleConns: 500, MaxIdleConnsPerHost: 200, IdleConnTimeout: durationpb.New(time.Minute)},
+			maxIdle:        500,
+			maxIdlePerHost: 200,
+			idleTimeout:    time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, _ := baseTransport(t, tt.upstream)
+			if tr.MaxIdleConns != tt.maxIdle || tr.MaxIdleConnsPerHost != tt.maxIdlePerHost || tr.IdleConnTimeout != tt.idleTimeout {
+				t.Fatalf("got MaxIdleConns=%d MaxIdleConnsPerHost=%d IdleConnTimeout=%s", tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.IdleConnTimeout)
+			}
+			// Far above the stdlib default of 2, which churns connections
+			// under concurrent streams.
+			if tr.MaxIdleConnsPerHost <= http.DefaultMaxIdleConnsPerHost {
+				t.Fatalf("MaxIdleConnsPerHost = %d", tr.MaxIdleConnsPerHost)
+			}
+		})
+	}
+}
+
+// modelUpstream fails requests for the models in failing with their status and
+// serves every other model, recording the order models were requested in.
+func modelUpstream(t *testing.T, failing map[string]int) (*httptest.Server, func() []string) {
+	t.Helper()
+	var (
+		mu    sync.Mutex
+		calls []string
+	)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Model  string `json:"model"`
+			Stream bool   `json:"stream"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		mu.Lock()
+		calls = append(calls, body.Model)
+		mu.Unlock()
+
+		if status, ok := failing[body.Model]; ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"error":{"message":"%s unavailable"}}`, body.Model)
+			return
+		}
+		if body.Stream {
+			writeSSE(w, body.Model, "hello")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"model":%q,"choices":[{"message":{"role":"assistant","content":"hello"}}]}`, body.Model)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), calls...)
+	}
+}
+
+func TestWithFallback(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		wantModel string
+		wantCalls []string
+	}{
+		{name: "rate limited", status: http.StatusTooManyRequests, wantModel: "gpt-4o-mini", wantCalls: []string{"gpt-4o", "gpt-4o-mini"}},
+		{name: "server error", status: http.StatusInternalServerError, wantModel: "gpt-4o-mini", wantCalls: []string{"gpt-4o", "gpt-4o-mini"}},
+		{name: "unavailable", status: http.StatusServiceUnavailable, wantModel: "gpt-4o-mini", wantCalls: []string{"gpt-4o", "gpt-4o-mini"}},
+		{name: "bad request is final", status: http.StatusBadRequest, wantCalls: []string{"gpt-4o"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Run("unary", func(t *testing.T) {
+				upstream, calls := modelUpstream(t, map[string]int{"gpt-4o": tt.status})
+				s := newTestService(t, &conf.Proxy{})
+				res, err := s.ChatCompletion(context.Background(), &pb.ChatCompletionRequest{
+					Url:            upstream.URL,
+					Model:          "gpt-4o",
+					FallbackModels: []string{"gpt-4o-mini"},
+					Messages:       userMessages("hi"),
+				})
+				if tt.wantModel == "" {
+					if err == nil {
+						t.Fatal("expected the upstream error")
+					}
+				} else if err != nil {
+					t.Fatal(err)
+				} else if res.GetModel() != tt.wantModel {
+					t.Fatalf("model = %q, want %q", res.GetModel(), tt.wantModel)
+				}
+				if got := calls(); !reflect.DeepEqual(got, tt.wantCalls) {
+					t.Fatalf("upstream calls = %v, want %v", got, tt.wantCalls)
+				}
+			})
+
+			t.Run("stream", func(t *testing.T) {
+				upstream, calls := modelUpstream(t, map[string]int{"gpt-4o": tt.status})
+				s := newTestService(t, &conf.Proxy{})
+				req := streamRequest(upstream.URL, "gpt-4o")
+				req.FallbackModels = []string{"gpt-4o-mini"}
+				stream := newFakeStream(context.Background())
+				err := s.StreamChatCompletion(req, stream)
+				if tt.wantModel == "" {
+					if err == nil {
+						t.Fatal("expected the upstream error")
+					}
+				} else if err != nil {
+					t.Fatal(err)
+				} else {
+					for _, r := range stream.responses() {
+						if r.GetModel() != tt.wantModel {
+							t.Fatalf("chunk model = %q, want %q", r.GetModel(), tt.wantModel)
+						}
+					}
+				}
+				if got := calls(); !reflect.DeepEqual(got, tt.wantCalls) {
+					t.Fatalf("upstream calls = %v, want %v", got, tt.wantCalls)
+				}
+			})
+		})
+	}
+}
+
+// The shipped config decodes into the client settings it documents.
+func TestNewHTTPClientConfigRoundTrip(t *testing.T) {
+	c := config.New(config.WithSource(file.NewSource("../../configs/config.yaml")))
+	defer c.Close()
+	if err := c.Load(); err != nil {
+		t.Fatal(err)
+	}
+	var bc conf.Bootstrap
+	if err := c.Scan(&bc); err != nil {
+		t.Fatal(err)
+	}
+	upstream := bc.GetProxy().GetUpstream()
+
+	tr, limit := baseTransport(t, upstream)
+	if tr.ResponseHeaderTimeout != 60*time.Second {
+		t.Errorf("ResponseHeaderTimeout = %s, want the configured 60s", tr.ResponseHeaderTimeout)
+	}
+	if d := newDialer(upstream).Timeout; d != 10*time.Second {
+		t.Errorf("connect timeout = %s, want the configured 10s", d)
+	}
+	if tr.MaxIdleConns != 100 || tr.MaxIdleConnsPerHost != 32 || tr.IdleConnTimeout != 90*time.Second {
+		t.Errorf("idle settings = %d/%d/%s", tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.IdleConnTimeout)
+	}
+	if limit.maxBytes != 64<<20 {
+		t.Errorf("max response bytes = %d", limit.maxBytes)
+	}
+	if upstream.GetBaseUrl() != "https://api.openai.com/v1" {
+		t.Errorf("base_url = %q", upstream.GetBaseUrl())
+	}
+}
+
+func TestNewHTTPClientTimeouts(t *testing.T) {
+	if d := newDialer(nil).Timeout; d != defaultConnectTimeout {
+		t.Fatalf("default connect timeout = %s, want %s", d, defaultConnectTimeout)
+	}
+	if d := newDialer(&conf.Proxy_Upstream{ConnectTimeout: durationpb.New(3 * time.Second)}).Timeout; d != 3*time.Second {
+		t.Fatalf("connect timeout = %s, want 3s", d)
+	}
+	if tr, _ := baseTransport(t, nil); tr.ResponseHeaderTimeout != 0 {
+		t.Fatalf("default ResponseHeaderTimeout = %s, want none", tr.ResponseHeaderTimeout)
+	}
+
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	s := newTestService(t, &conf.Proxy{Upstream: &conf.Proxy_Upstream{ResponseHeaderTimeout: durationpb.New(50 * time.Millisecond)}})
+	_, err := s.ChatCompletion(context.Background(), &pb.ChatCompletionRequest{Url: upstream.URL, Model: "gpt-4o", Messages: userMessages("hi")})
+	if err == nil || !strings.Contains(err.Error(), "timeout awaiting response headers") {
+		t.Fatalf("err = %v, want the response header timeout", err)
+	}
+}
+
+func TestNewHTTPClientProxyURL(t *testing.T) {
+	var proxied atomic.Value
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A forward proxy sees the absolute upstream URL.
+		proxied.Store(r.URL.String())
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"via proxy"}}]}`)
+	}))
+	defer proxy.Close()
+
+	s := newTestService(t, &conf.Proxy{Upstream: &conf.Proxy_Upstream{ProxyUrl: proxy.URL}})
+	res, err := s.ChatCompletion(context.Background(), &pb.ChatCompletionRequest{
+		Url: "http://upstream.invalid/v1", Model: "gpt-4o", Messages: userMessages("hi"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.GetContent() != "via proxy" || proxied.Load() != "http://upstream.invalid/v1/chat/completions" {
+		t.Fatalf("content %q, proxy saw %v", res.GetContent(), proxied.Load())
+	}
+
+	if _, err := NewHTTPClient(&conf.Proxy{Upstream: &conf.Proxy_Upstream{ProxyUrl: "://bad"}}); err == nil {
+		t.Fatal("invalid proxy_url accepted")
+	}
+}
+
+func TestNewClientBaseURLFallback(t *testing.T) {
+	serve := func(name string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"choices":[{"message":{"role":"assistant","content":%q}}]}`, name)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	base, override := serve("base"), serve("override")
+
+	s := newTestService(t, &conf.Proxy{Upstream: &conf.Proxy_Upstream{BaseUrl: base.URL}})
+	for url, want := range map[string]string{"": "base", override.URL: "override"} {
+		res, err := s.ChatCompletion(context.Background(), &pb.ChatCompletionRequest{Url: url, Model: "gpt-4o", Messages: userMessages("hi")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.GetContent() != want {
+			t.Fatalf("url %q served by %q, want %q", url, res.GetContent(), want)
+		}
+	}
+}
+
+func TestBudgetSpent(t *testing.T) {
+	clock := newFakeClock()
+	s := newTestService(t, &conf.Proxy{}, WithClock(clock))
+	start := clock.Now()
+	clock.Advance(10 * time.Second)
+
+	tests := []struct {
+		name     string
+		retry    *conf.Proxy_Retry
+		attempts int
+		want     bool
+	}{
+		{name: "unlimited", retry: nil, attempts: 100},
+		{name: "attempts left", retry: &conf.Proxy_Retry{MaxAttempts: 3}, attempts: 2},
+		{name: "attempts spent", retry: &conf.Proxy_Retry{MaxAttempts: 3}, attempts: 3, want: true},
+		{name: "time left", retry: &conf.Proxy_Retry{MaxElapsed: durationpb.New(11 * time.Second)}, attempts: 1},
+		{name: "time spent", retry: &conf.Proxy_Retry{MaxElapsed: durationpb.New(10 * time.Second)}, attempts: 1, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.budgetSpent(tt.retry, tt.attempts, start); got != tt.want {
+				t.Fatalf("budgetSpent = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryBudgetStopsFallbacks(t *testing.T) {
+	down := map[string]int{"gpt-4o": http.StatusServiceUnavailable, "gpt-4o-mini": http.StatusServiceUnavailable, "gpt-3.5-turbo": http.StatusServiceUnavailable}
+	request := func(url string) *pb.ChatCompletionRequest {
+		return &pb.ChatCompletionRequest{
+			Url:            url,
+			Model:          "gpt-4o",
+			FallbackModels: []string{"gpt-4o-mini", "gpt-3.5-turbo"},
+			Messages:       userMessages("hi"),
+		}
+	}
+
+	t.Run("max_attempts", func(t *testing.T) {
+		upstream, calls := modelUpstream(t, down)
+		s := newTestService(t, &conf.Proxy{Retry: &conf.Proxy_Retry{PerModel: 2, MaxAttempts: 4}})
+		if _, err := s.ChatCompletion(context.Background(), request(upstream.URL)); err == nil {
+			t.Fatal("expected the upstream error")
+		}
+		want := []string{"gpt-4o", "gpt-4o", "gpt-4o", "gpt-4o-mini"}
+		if got := calls(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("upstream calls = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("max_elapsed", func(t *testing.T) {
+		upstream, calls := modelUpstream(t, down)
+		clock := newFakeClock()
+		s := newTestService(t, &conf.Proxy{Retry: &conf.Proxy_Retry{
+			PerModel:   1,
+			Backoff:    durationpb.New(10 * time.Second),
+			MaxElapsed: durationpb.New(15 * time.Second),
+		}}, WithClock(clock))
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := s.ChatCompletion(context.Background(), request(upstream.URL))
+			done <- err
+		}()
+		// Two backoffs: one retrying gpt-4o, one retrying gpt-4o-mini.
+		for i := 0; i < 2; i++ {
+			clock.waitForWaiters(t, 1)
+			clock.Advance(10 * time.Second)
+		}
+		if err := <-done; err == nil {
+			t.Fatal("expected the upstream error")
+		}
+		want := []string{"gpt-4o", "gpt-4o", "gpt-4o-mini", "gpt-4o-mini"}
+		if got := calls(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("upstream calls = %v, want %v", got, want)
+		}
+	})
+}
@@ -0,0 +1,231 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/errors"
+	"github.com/go-kratos/kratos/v2/log"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+// fakeClock is a Clock that only moves when Advance is called.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+	// created and seen count waiters for waitForWaiters
+	created, seen int
+}
+
+type fakeWaiter struct {
+	at     time.Time
+	period time.Duration
+	c      chan time.Time
+	f      func()
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.add(&fakeWaiter{at: c.Now().Add(d), c: make(chan time.Time, 1)}).c
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	return &fakeTicker{c, c.add(&fakeWaiter{at: c.Now().Add(d), period: d, c: make(chan time.Time, 1)})}
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	return &fakeTimer{c, c.add(&fakeWaiter{at: c.Now().Add(d), f: f})}
+}
+
+func (c *fakeClock) add(w *fakeWaiter) *fakeWaiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waiters = append(c.waiters, w)
+	c.created++
+	return w
+}
+
+// stop removes w and reports whether it was still pending.
+func (c *fakeClock) stop(w *fakeWaiter) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, o := range c.waiters {
+		if o == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// waitForWaiters blocks until n timers, tickers or After channels have been
+// created since the last call.
+func (c *fakeClock) waitForWaiters(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		if c.created-c.seen >= n {
+			c.seen += n
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d clock waiters", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Advance moves the clock forward by d and fires everything that came due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeWaiter
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		due = append(due, w)
+		if w.period > 0 {
+			w.at = c.now.Add(w.period)
+			pending = append(pending, w)
+		}
+	}
+	c.waiters = pending
+	now := c.now
+	c.mu.Unlock()
+
+	for _, w := range due {
+		if w.f != nil {
+			go w.f()
+			continue
+		}
+		select {
+		case w.c <- now:
+		default:
+		}
+	}
+}
+
+type fakeTicker struct {
+	clock *fakeClock
+	w     *fakeWaiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.w.c }
+func (t *fakeTicker) Stop()               { t.clock.stop(t.w) }
+
+type fakeTimer struct {
+	clock *fakeClock
+	w     *fakeWaiter
+}
+
+func (t *fakeTimer) Stop() bool { return t.clock.stop(t.w) }
+
+func TestWithTimeoutCause(t *testing.T) {
+	clock := newFakeClock()
+	cause := pb.ErrorStreamTimeout("too slow")
+	ctx, cancel := withTimeoutCause(context.Background(), clock, time.Minute, cause)
+	defer cancel()
+	clock.waitForWaiters(t, 1)
+
+	clock.Advance(59 * time.Second)
+	select {
+	case <-ctx.Done():
+		t.Fatal("context done before the timeout elapsed")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not done after the timeout elapsed")
+	}
+	if got := context.Cause(ctx); got != cause {
+		t.Fatalf("cause = %v, want %v", got, cause)
+	}
+}
+
+func TestWithTimeoutCauseCancel(t *testing.T) {
+	clock := newFakeClock()
+	ctx, cancel := withTimeoutCause(context.Background(), clock, time.Minute, pb.ErrorStreamTimeout(""))
+	clock.waitForWaiters(t, 1)
+	cancel()
+
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("err = %v, want %v", ctx.Err(), context.Canceled)
+	}
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	if len(clock.waiters) != 0 {
+		t.Fatalf("cancel left %d timers pending", len(clock.waiters))
+	}
+}
+
+func TestUpstreamTimeoutUsesClock(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	c := &conf.Proxy{}
+	clock := newFakeClock()
+	s := NewOpenAIService(c, NewRuntimeConfig(c), upstream.Client(), nil, NewQuotaStore(), log.DefaultLogger, WithClock(clock))
+	s.upstreamTimeout = time.Minute
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.ChatCompletion(context.Background(), &pb.ChatCompletionRequest{
+			Url:      upstream.URL,
+			Model:    "gpt-4o",
+			Messages: []*pb.ChatCompletionMessage{{Role: pb.ChatCompletionMessageRole_CHAT_COMPLETION_MESSAGE_ROLE_USER, Content: "hi"}},
+		})
+		done <- err
+	}()
+	clock.waitForWaiters(t, 1)
+
+	clock.Advance(time.Minute)
+	select {
+	case err := <-done:
+		if !pb.IsUpstreamTimeout(err) {
+			t.Fatalf("err = %v (%s), want UPSTREAM_TIMEOUT", err, errors.Reason(err))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ChatCompletion did not return after the upstream timeout")
+	}
+}
+
+func TestQuotaMonthUsesClock(t *testing.T) {
+	clock := newFakeClock()
+	q := &quota{store: NewQuotaStore(), clock: clock}
+	if got := q.month(); got != "2024-01" {
+		t.Fatalf("month = %q, want 2024-01", got)
+	}
+	clock.Advance(time.Hour)
+	if got := q.month(); got != "2024-02" {
+		t.Fatalf("month = %q, want 2024-02", got)
+	}
+}
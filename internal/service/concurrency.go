@@ -0,0 +1,56 @@
+package service
+
+import (
+	"sync"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+// streamLimiter caps concurrent streams globally and per caller. Zero disables
+// a cap. Excess streams are rejected immediately rather than queued.
+type streamLimiter struct {
+	max       int
+	perCaller int
+
+	mu      sync.Mutex
+	active  int
+	callers map[string]int
+}
+
+func newStreamLimiter(c *conf.Proxy_Concurrency) *streamLimiter {
+	return &streamLimiter{
+		max:       int(c.GetMaxStreams()),
+		perCaller: int(c.GetMaxStreamsPerCaller()),
+		callers:   make(map[string]int),
+	}
+}
+
+// acquire takes a slot for caller. The returned function releases it and must
+// be deferred so the slot is freed on every exit path, including panics.
+func (l *streamLimiter) acquire(caller string) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.max > 0 && l.active >= l.max {
+		return nil, pb.ErrorTooManyStreams("%d concurrent streams in flight", l.active)
+	}
+	if l.perCaller > 0 && caller != "" && l.callers[caller] >= l.perCaller {
+		return nil, pb.ErrorTooManyStreams("caller %s has %d concurrent streams in flight", caller, l.callers[caller])
+	}
+	l.active++
+	l.callers[caller]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			l.active--
+			if l.callers[caller]--; l.callers[caller] == 0 {
+				delete(l.callers, caller)
+			}
+		})
+	}, nil
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-kratos/kratos/v2/log"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/auth"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+func TestStreamLimiterCapsUnderParallelLoad(t *testing.T) {
+	const (
+		maxStreams = 8
+		perCaller  = 3
+		callers    = 5
+		workers    = 40
+		rounds     = 200
+	)
+	l := newStreamLimiter(&conf.Proxy_Concurrency{MaxStreams: maxStreams, MaxStreamsPerCaller: perCaller})
+
+	var (
+		active    atomic.Int32
+		perActive [callers]atomic.Int32
+		admitted  atomic.Int32
+		wg        sync.WaitGroup
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			c := w % callers
+			caller := fmt.Sprintf("caller-%d", c)
+			for i := 0; i < rounds; i++ {
+				release, err := l.acquire(caller)
+				if err != nil {
+					if !pb.IsTooManyStreams(err) {
+						t.Errorf("err = %v, want TOO_MANY_STREAMS", err)
+					}
+					continue
+				}
+				admitted.Add(1)
+				if n := active.Add(1); n > maxStreams {
+					t.Errorf("%d streams active, cap is %d", n, maxStreams)
+				}
+				if n := perActive[c].Add(1); n > perCaller {
+					t.Errorf("%s has %d streams active, cap is %d", caller, n, perCaller)
+				}
+				perActive[c].Add(-1)
+				active.Add(-1)
+				release()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if admitted.Load() == 0 {
+		t.Fatal("no stream was admitted")
+	}
+	if l.active != 0 || len(l.callers) != 0 {
+		t.Fatalf("slots leaked: active %d, callers %v", l.active, l.callers)
+	}
+}
+
+func TestStreamLimiterReleaseOnce(t *testing.T) {
+	l := newStreamLimiter(&conf.Proxy_Concurrency{MaxStreams: 2})
+	r1, err := l.acquire("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := l.acquire("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.acquire("c"); !pb.IsTooManyStreams(err) {
+		t.Fatalf("err = %v, want TOO_MANY_STREAMS", err)
+	}
+
+	r1()
+	r1()
+	if l.active != 1 {
+		t.Fatalf("double release freed %d slots", 2-l.active)
+	}
+	r2()
+}
+
+func TestStreamLimiterAnonymousCallers(t *testing.T) {
+	l := newStreamLimiter(&conf.Proxy_Concurrency{MaxStreamsPerCaller: 1})
+	for i := 0; i < 3; i++ {
+		if _, err := l.acquire(""); err != nil {
+			t.Fatalf("per-caller cap applied without authentication: %v", err)
+		}
+	}
+}
+
+func TestStreamSlotReleasedOnPanic(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeSSE(w, "gpt-4o", "hello")
+	}))
+	defer upstream.Close()
+
+	c := &conf.Proxy{Concurrency: &conf.Proxy_Concurrency{MaxStreams: 1, MaxStreamsPerCaller: 1}}
+	httpClient, err := NewHTTPClient(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	panicking := ResponseInterceptorFunc(func(context.Context, *pb.StreamChatCompletionResponse) (*pb.StreamChatCompletionResponse, error) {
+		panic("boom")
+	})
+	s := NewOpenAIService(c, NewRuntimeConfig(c), httpClient, []ResponseInterceptor{panicking}, NewQuotaStore(), log.NewStdLogger(io.Discard))
+
+	ctx := auth.NewContext(context.Background(), "alice")
+	for i := 0; i < 3; i++ {
+		err := s.StreamChatCompletion(streamRequest(upstream.URL, "gpt-4o"), newFakeStream(ctx))
+		if !pb.IsInternalError(err) {
+			t.Fatalf("stream %d err = %v, want INTERNAL_ERROR from the recovered panic", i, err)
+		}
+	}
+	if s.limiter.active != 0 || len(s.limiter.callers) != 0 {
+		t.Fatalf("panicking streams leaked slots: active %d, callers %v", s.limiter.active, s.limiter.callers)
+	}
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+)
+
+// reservedParams are the JSON fields of the typed upstream request, which
+// extra_params may not set.
+var reservedParams = func() map[string]bool {
+	reserved := make(map[string]bool)
+	t := reflect.TypeOf(openai.ChatCompletionRequest{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			reserved[name] = true
+		}
+	}
+	return reserved
+}()
+
+type extraParamsKey struct{}
+
+// withExtraParams validates extra and attaches it to ctx for extraParamsTransport.
+func withExtraParams(ctx context.Context, extra *structpb.Struct) (context.Context, error) {
+	if len(extra.GetFields()) == 0 {
+		return ctx, nil
+	}
+	for key := range extra.GetFields() {
+		if reservedParams[key] {
+			return nil, pb.ErrorInvalidParameter("extra_params key %s is reserved", key)
+		}
+	}
+	return withBodyParams(ctx, extra.AsMap()), nil
+}
+
+// withBodyParams attaches params for extraParamsTransport, on top of any
+// attached earlier.
+func withBodyParams(ctx context.Context, params map[string]interface{}) context.Context {
+	if len(params) == 0 {
+		return ctx
+	}
+	prev, _ := ctx.Value(extraParamsKey{}).(map[string]interface{})
+	merged := make(map[string]interface{}, len(prev)+len(params))
+	for k, v := range prev {
+		merged[k] = v
+	}
+	for k, v := range params {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, extraParamsKey{}, merged)
+}
+
+// extraParamsTransport merges the extra params of the request context into the
+// JSON body, so callers can use upstream knobs before they get typed fields.
+// Keys already present in the body are never overridden.
+type extraParamsTransport struct {
+	base http.RoundTripper
+}
+
+func (t extraParamsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	extra, ok := req.Context().Value(extraParamsKey{}).(map[string]interface{})
+	if !ok || req.Body == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	raw, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return nil, err
+	}
+	for key, value := range extra {
+		if _, ok := body[key]; ok {
+			continue
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		body[key] = b
+	}
+	if raw, err = json.Marshal(body); err != nil {
+		return nil, err
+	}
+
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(raw))
+	req.ContentLength = int64(len(raw))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(raw)), nil
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/structpb"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+func TestExtraParamsReachUpstream(t *testing.T) {
+	var body atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		if r.ContentLength != int64(len(raw)) {
+			t.Errorf("Content-Length = %d, body has %d bytes", r.ContentLength, len(raw))
+		}
+		var b map[string]any
+		if err := json.Unmarshal(raw, &b); err != nil {
+			t.Errorf("upstream body: %v", err)
+		}
+		body.Store(b)
+		writeSSE(w, "gpt-4o", "hi")
+	}))
+	defer upstream.Close()
+
+	extra, err := structpb.NewStruct(map[string]any{
+		"verbosity":  "low",
+		"web_search": map[string]any{"enabled": true, "max_results": 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestService(t, &conf.Proxy{})
+	req := streamRequest(upstream.URL, "gpt-4o")
+	req.ExtraParams = extra
+	if err := s.StreamChatCompletion(req, newFakeStream(context.Background())); err != nil {
+		t.Fatal(err)
+	}
+
+	b := body.Load().(map[string]any)
+	if b["verbosity"] != "low" {
+		t.Fatalf("verbosity = %v", b["verbosity"])
+	}
+	search, _ := b["web_search"].(map[string]any)
+	if search["enabled"] != true || search["max_results"] != 3.0 {
+		t.Fatalf("web_search = %v", b["web_search"])
+	}
+	// The typed fields are still there.
+	if b["model"] != "gpt-4o" || b["stream"] != true {
+		t.Fatalf("typed fields lost: %v", b)
+	}
+}
+
+func TestExtraParamsRejectReservedKeys(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		writeSSE(w, "gpt-4o", "hi")
+	}))
+	defer upstream.Close()
+
+	s := newTestService(t, &conf.Proxy{})
+	for _, key := range []string{"model", "messages", "stream", "temperature", "max_completion_tokens"} {
+		t.Run(key, func(t *testing.T) {
+			extra, _ := structpb.NewStruct(map[string]any{key: "x"})
+			req := streamRequest(upstream.URL, "gpt-4o")
+			req.ExtraParams = extra
+			err := s.StreamChatCompletion(req, newFakeStream(context.Background()))
+			if !pb.IsInvalidParameter(err) || !strings.Contains(err.Error(), key) {
+				t.Fatalf("err = %v, want INVALID_PARAMETER naming %s", err, key)
+			}
+		})
+	}
+	if n := calls.Load(); n != 0 {
+		t.Fatalf("upstream called %d times", n)
+	}
+}
+
+func TestExtraParamsTransport(t *testing.T) {
+	var got string
+	base := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		raw, _ := io.ReadAll(r.Body)
+		got = string(raw)
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+	send := func(ctx context.Context, body string) {
+		t.Helper()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "http://upstream.invalid", strings.NewReader(body))
+		if _, err := (extraParamsTransport{base: base}).RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(context.Background(), `{"model":"gpt-4o"}`)
+	if got != `{"model":"gpt-4o"}` {
+		t.Fatalf("body without extra params rewritten to %s", got)
+	}
+
+	ctx := withBodyParams(context.Background(), map[string]interface{}{"model": "other", "seed": 7})
+	ctx = withBodyParams(ctx, map[string]interface{}{"top_k": 40})
+	send(ctx, `{"model":"gpt-4o"}`)
+	if want := `{"model":"gpt-4o","seed":7,"top_k":40}`; got != want {
+		t.Fatalf("body = %s, want %s", got, want)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestWithExtraParamsEmpty(t *testing.T) {
+	ctx := context.Background()
+	got, err := withExtraParams(ctx, nil)
+	if err != nil || got != ctx {
+		t.Fatalf("nil extra params changed the context: %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+package service
+
+import (
+	"encoding/json"
+	"regexp"
+
+	openai "github.com/sashabaranov/go-openai"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+)
+
+// schemaName is the response format name pattern upstreams accept.
+var schemaName = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// rawSchema passes a validated JSON schema through unchanged.
+type rawSchema json.RawMessage
+
+func (s rawSchema) MarshalJSON() ([]byte, error) {
+	return s, nil
+}
+
+// convertResponseFormat validates a requested JSON schema and converts it to
+// a json_schema response format. A nil schema leaves the format unset.
+func convertResponseFormat(schema *pb.JSONSchema) (*openai.ChatCompletionResponseFormat, error) {
+	if schema == nil {
+		return nil, nil
+	}
+	if !schemaName.MatchString(schema.GetName()) {
+		return nil, pb.ErrorInvalidParameter("json_schema: invalid name %q", schema.GetName())
+	}
+	if !json.Valid([]byte(schema.GetSchema())) {
+		return nil, pb.ErrorInvalidParameter("json_schema: schema is not valid JSON")
+	}
+	return &openai.ChatCompletionResponseFormat{
+		Type: openai.ChatCompletionResponseFormatTypeJSONSchema,
+		JSONSchema: &openai.ChatCompletionResponseFormatJSONSchema{
+			Name:   schema.GetName(),
+			Schema: rawSchema(schema.GetSchema()),
+			Strict: schema.GetStrict(),
+		},
+	}, nil
+}
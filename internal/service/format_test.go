@@ -0,0 +1,150 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+const personSchema = `{"type":"object","properties":{"name":{"type":"string"}},"required":["name"]}`
+
+func TestConvertResponseFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  *pb.JSONSchema
+		wantErr string
+	}{
+		{name: "unset"},
+		{name: "strict", schema: &pb.JSONSchema{Name: "person", Schema: personSchema, Strict: true}},
+		{name: "not strict", schema: &pb.JSONSchema{Name: "person-v2", Schema: personSchema}},
+		{name: "empty name", schema: &pb.JSONSchema{Schema: personSchema}, wantErr: "invalid name"},
+		{name: "invalid name", schema: &pb.JSONSchema{Name: "a person", Schema: personSchema}, wantErr: "invalid name"},
+		{name: "invalid schema", schema: &pb.JSONSchema{Name: "person", Schema: `{"type":`}, wantErr: "not valid JSON"},
+		{name: "missing schema", schema: &pb.JSONSchema{Name: "person"}, wantErr: "not valid JSON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := convertResponseFormat(tt.schema)
+			if tt.wantErr != "" {
+				if !pb.IsInvalidParameter(err) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want INVALID_PARAMETER with %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.schema == nil {
+				if format != nil {
+					t.Fatalf("format = %+v, want unset", format)
+				}
+				return
+			}
+			js := format.JSONSchema
+			if format.Type != openai.ChatCompletionResponseFormatTypeJSONSchema || js.Name != tt.schema.GetName() || js.Strict != tt.schema.GetStrict() {
+				t.Fatalf("format = %+v, schema %+v", format, js)
+			}
+			if b, err := json.Marshal(js.Schema); err != nil || string(b) != tt.schema.GetSchema() {
+				t.Fatalf("schema = %s (%v), want it unchanged", b, err)
+			}
+		})
+	}
+}
+
+func TestResponseFormatReachesUpstream(t *testing.T) {
+	upstream, body := bodyUpstream(t)
+	s := newTestService(t, &conf.Proxy{})
+	schema := &pb.JSONSchema{Name: "person", Schema: personSchema, Strict: true}
+
+	var want map[string]any
+	if err := json.Unmarshal([]byte(`{"type":"json_schema","json_schema":{"name":"person","strict":true,"schema":`+personSchema+`}}`), &want); err != nil {
+		t.Fatal(err)
+	}
+	check := func(t *testing.T) {
+		t.Helper()
+		if got := body()["response_format"]; !reflect.DeepEqual(got, want) {
+			t.Fatalf("response_format = %v, want %v", got, want)
+		}
+	}
+	t.Run("unary", func(t *testing.T) {
+		_, err := s.ChatCompletion(context.Background(), &pb.ChatCompletionRequest{Url: upstream.URL, Model: "gpt-4o", Messages: userMessages("hi"), JsonSchema: schema})
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+	t.Run("stream", func(t *testing.T) {
+		req := streamRequest(upstream.URL, "gpt-4o")
+		req.JsonSchema = schema
+		if err := s.StreamChatCompletion(req, newFakeStream(context.Background())); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+	t.Run("unset", func(t *testing.T) {
+		if err := s.StreamChatCompletion(streamRequest(upstream.URL, "gpt-4o"), newFakeStream(context.Background())); err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := body()["response_format"]; ok {
+			t.Fatalf("response_format = %v, want it omitted", got)
+		}
+	})
+}
+
+func TestRefusalForwarded(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b struct{ Stream bool }
+		json.NewDecoder(r.Body).Decode(&b)
+		if !b.Stream {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"model":"gpt-4o","choices":[{"message":{"role":"assistant","content":"","refusal":"I can't help with that."}}]}`))
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, d := range []string{"I can't ", "help with that."} {
+			fmt.Fprintf(w, "data: {\"model\":\"gpt-4o\",\"choices\":[{\"delta\":{\"refusal\":%q}}]}\n\n", d)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	s := newTestService(t, &conf.Proxy{})
+	schema := &pb.JSONSchema{Name: "person", Schema: personSchema}
+
+	res, err := s.ChatCompletion(context.Background(), &pb.ChatCompletionRequest{Url: upstream.URL, Model: "gpt-4o", Messages: userMessages("hi"), JsonSchema: schema})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.GetRefusal() != "I can't help with that." || res.GetContent() != "" {
+		t.Fatalf("unary refusal = %q, content = %q", res.GetRefusal(), res.GetContent())
+	}
+
+	req := streamRequest(upstream.URL, "gpt-4o")
+	req.JsonSchema = schema
+	stream := newFakeStream(context.Background())
+	if err := s.StreamChatCompletion(req, stream); err != nil {
+		t.Fatal(err)
+	}
+	if got := stream.content(); got != "" {
+		t.Fatalf("refusal streamed as content %q", got)
+	}
+	var refusals []string
+	for _, r := range stream.responses() {
+		if r.GetRefusal() != "" {
+			refusals = append(refusals, r.GetRefusal())
+		}
+	}
+	if !reflect.DeepEqual(refusals, []string{"I can't help with that."}) {
+		t.Fatalf("stream refusals = %q, want the joined refusal once", refusals)
+	}
+}
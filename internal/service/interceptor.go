@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+// ResponseInterceptor post-processes stream responses right before they are
+// sent to the client. Returning a nil response drops the chunk, returning an
+// error aborts the stream.
+type ResponseInterceptor interface {
+	Intercept(ctx context.Context, res *pb.StreamChatCompletionResponse) (*pb.StreamChatCompletionResponse, error)
+}
+
+// ResponseInterceptorFunc adapts a function to a ResponseInterceptor.
+type ResponseInterceptorFunc func(ctx context.Context, res *pb.StreamChatCompletionResponse) (*pb.StreamChatCompletionResponse, error)
+
+func (f ResponseInterceptorFunc) Intercept(ctx context.Context, res *pb.StreamChatCompletionResponse) (*pb.StreamChatCompletionResponse, error) {
+	return f(ctx, res)
+}
+
+// NewResponseInterceptors builds the interceptor chain enabled in config.
+func NewResponseInterceptors(c *conf.Proxy) []ResponseInterceptor {
+	var interceptors []ResponseInterceptor
+	if n := c.GetStream().GetTruncateChunkRunes(); n > 0 {
+		interceptors = append(interceptors, TruncateInterceptor(int(n)))
+	}
+	return interceptors
+}
+
+// TruncateInterceptor cuts every chunk down to at most n runes.
+func TruncateInterceptor(n int) ResponseInterceptor {
+	return ResponseInterceptorFunc(func(ctx context.Context, res *pb.StreamChatCompletionResponse) (*pb.StreamChatCompletionResponse, error) {
+		runes := []rune(res.GetChunk())
+		if len(runes) <= n {
+			return res, nil
+		}
+		res = proto.Clone(res).(*pb.StreamChatCompletionResponse)
+		res.Chunk = string(runes[:n])
+		return res, nil
+	})
+}
+
+// intercept runs res through the interceptor chain. A nil response means the
+// chunk was dropped.
+func (s *OpenAIService) intercept(ctx context.Context, res *pb.StreamChatCompletionResponse) (*pb.StreamChatCompletionResponse, error) {
+	for _, interceptor := range s.interceptors {
+		var err error
+		res, err = interceptor.Intercept(ctx, res)
+		if err != nil {
+			return nil, pb.ErrorInternalError("response interceptor error: %s", err.Error())
+		}
+		if res == nil {
+			return nil, nil
+		}
+	}
+	return res, nil
+}
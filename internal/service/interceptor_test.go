@@ -0,0 +1,107 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kratos/kratos/v2/log"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+func interceptedStream(t *testing.T, interceptors ...ResponseInterceptor) (*fakeStream, error) {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeSSE(w, "gpt-4o", "hello ", "drop me ", "world")
+	}))
+	defer upstream.Close()
+
+	c := &conf.Proxy{}
+	httpClient, err := NewHTTPClient(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewOpenAIService(c, NewRuntimeConfig(c), httpClient, interceptors, NewQuotaStore(), log.DefaultLogger)
+	stream := newFakeStream(context.Background())
+	return stream, s.StreamChatCompletion(streamRequest(upstream.URL, "gpt-4o"), stream)
+}
+
+var (
+	upper = ResponseInterceptorFunc(func(ctx context.Context, res *pb.StreamChatCompletionResponse) (*pb.StreamChatCompletionResponse, error) {
+		res.Chunk = strings.ToUpper(res.GetChunk())
+		return res, nil
+	})
+	dropMarked = ResponseInterceptorFunc(func(ctx context.Context, res *pb.StreamChatCompletionResponse) (*pb.StreamChatCompletionResponse, error) {
+		if strings.Contains(strings.ToLower(res.GetChunk()), "drop") {
+			return nil, nil
+		}
+		return res, nil
+	})
+)
+
+func TestInterceptorModifies(t *testing.T) {
+	stream, err := interceptedStream(t, upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stream.content(); got != "HELLO DROP ME WORLD" {
+		t.Fatalf("content = %q", got)
+	}
+}
+
+func TestInterceptorDrops(t *testing.T) {
+	stream, err := interceptedStream(t, dropMarked, upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stream.content(); got != "HELLO WORLD" {
+		t.Fatalf("content = %q", got)
+	}
+	// The usage event still reaches the client.
+	if got := stream.responses(); got[len(got)-1].GetUsage() == nil {
+		t.Fatalf("last response = %v, want usage", got[len(got)-1])
+	}
+}
+
+func TestInterceptorError(t *testing.T) {
+	var calls int
+	failing := ResponseInterceptorFunc(func(ctx context.Context, res *pb.StreamChatCompletionResponse) (*pb.StreamChatCompletionResponse, error) {
+		if calls++; calls == 2 {
+			return nil, errors.New("policy violation")
+		}
+		return res, nil
+	})
+	stream, err := interceptedStream(t, failing, upper)
+	if !pb.IsInternalError(err) {
+		t.Fatalf("err = %v, want INTERNAL_ERROR", err)
+	}
+	if !strings.Contains(err.Error(), "policy violation") {
+		t.Fatalf("err = %v, want the interceptor's message", err)
+	}
+	if got := stream.content(); got != "HELLO " {
+		t.Fatalf("content = %q, want only the chunk before the failure", got)
+	}
+}
+
+func TestNewResponseInterceptors(t *testing.T) {
+	if got := NewResponseInterceptors(&conf.Proxy{}); len(got) != 0 {
+		t.Fatalf("got %d interceptors without config", len(got))
+	}
+	chain := NewResponseInterceptors(&conf.Proxy{Stream: &conf.Proxy_Stream{TruncateChunkRunes: 2}})
+	if len(chain) != 1 {
+		t.Fatalf("got %d interceptors, want truncate", len(chain))
+	}
+	in := &pb.StreamChatCompletionResponse{Chunk: "你好世界"}
+	res, err := chain[0].Intercept(context.Background(), in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.GetChunk() != "你好" || in.GetChunk() != "你好世界" {
+		t.Fatalf("got %q, input now %q", res.GetChunk(), in.GetChunk())
+	}
+}
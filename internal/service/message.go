@@ -0,0 +1,276 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	openai "github.com/sashabaranov/go-openai"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+const (
+	defaultMaxMessages     = 1000
+	defaultMaxMessageRunes = 200000
+	defaultMaxRequestBytes = 10 << 20
+	defaultMaxImages       = 16
+	defaultMaxImageBytes   = 5 << 20
+)
+
+type limits struct {
+	maxMessages     int
+	maxMessageRunes int
+	maxRequestBytes int
+	maxImages       int
+	maxImageBytes   int
+}
+
+func newLimits(c *conf.Proxy_Limits) limits {
+	l := limits{
+		maxMessages:     defaultMaxMessages,
+		maxMessageRunes: defaultMaxMessageRunes,
+		maxRequestBytes: defaultMaxRequestBytes,
+		maxImages:       defaultMaxImages,
+		maxImageBytes:   defaultMaxImageBytes,
+	}
+	if c.GetMaxMessages() > 0 {
+		l.maxMessages = int(c.GetMaxMessages())
+	}
+	if c.GetMaxMessageRunes() > 0 {
+		l.maxMessageRunes = int(c.GetMaxMessageRunes())
+	}
+	if c.GetMaxRequestBytes() > 0 {
+		l.maxRequestBytes = int(c.GetMaxRequestBytes())
+	}
+	if c.GetMaxImages() > 0 {
+		l.maxImages = int(c.GetMaxImages())
+	}
+	if c.GetMaxImageBytes() > 0 {
+		l.maxImageBytes = int(c.GetMaxImageBytes())
+	}
+	return l
+}
+
+// check rejects requests that exceed the configured size limits before anything
+// is sent upstream. size is the serialized size of the whole request.
+func (l limits) check(size int, messages []*pb.ChatCompletionMessage) error {
+	if size > l.maxRequestBytes {
+		return pb.ErrorRequestTooLarge("request size %d bytes exceeds max_request_bytes %d", size, l.maxRequestBytes)
+	}
+	if len(messages) > l.maxMessages {
+		return pb.ErrorRequestTooLarge("message count %d exceeds max_messages %d", len(messages), l.maxMessages)
+	}
+	images := 0
+	for i, v := range messages {
+		n := utf8.RuneCountInString(v.GetContent())
+		for _, part := range v.GetParts() {
+			n += utf8.RuneCountInString(part.GetText())
+			if size := len(part.GetImageUrl()); size > 0 {
+				if images++; images > l.maxImages {
+					return pb.ErrorRequestTooLarge("image count exceeds max_images %d", l.maxImages)
+				}
+				if size > l.maxImageBytes {
+					return pb.ErrorRequestTooLarge("message %d has a %d byte image, exceeds max_image_bytes %d", i, size, l.maxImageBytes)
+				}
+			}
+		}
+		if n > l.maxMessageRunes {
+			return pb.ErrorRequestTooLarge("message %d has %d runes, exceeds max_message_runes %d", i, n, l.maxMessageRunes)
+		}
+	}
+	return nil
+}
+
+// checkSampling flags requests that set both temperature and top_p, since
+// upstreams recommend tuning only one of them. Such requests are rejected when
+// configured and otherwise only logged.
+func (s *OpenAIService) checkSampling(ctx context.Context, temperature, topP float32) error {
+	if temperature == 0 || topP == 0 {
+		return nil
+	}
+	if s.rt.load().sampling.GetRejectConflicting() {
+		return pb.ErrorInvalidParameter("set either temperature or top_p, not both")
+	}
+	s.log.WithContext(ctx).Warnf("request sets both temperature %v and top_p %v", temperature, topP)
+	return nil
+}
+
+const (
+	maxStopSequences = 4
+	maxStopRunes     = 256
+)
+
+// checkStop enforces the upstream limits on stop sequences.
+func checkStop(stop []string) error {
+	if len(stop) > maxStopSequences {
+		return pb.ErrorInvalidParameter("stop has %d sequences, at most %d allowed", len(stop), maxStopSequences)
+	}
+	for i, v := range stop {
+		if v == "" {
+			return pb.ErrorInvalidParameter("stop sequence %d is empty", i)
+		}
+		if n := utf8.RuneCountInString(v); n > maxStopRunes {
+			return pb.ErrorInvalidParameter("stop sequence %d has %d runes, at most %d allowed", i, n, maxStopRunes)
+		}
+	}
+	return nil
+}
+
+// roleToString maps a proto message role to the OpenAI chat role.
+func roleToString(role pb.ChatCompletionMessageRole) (string, error) {
+	switch role {
+	case pb.ChatCompletionMessageRole_CHAT_COMPLETION_MESSAGE_ROLE_SYSTEM:
+		return openai.ChatMessageRoleSystem, nil
+	case pb.ChatCompletionMessageRole_CHAT_COMPLETION_MESSAGE_ROLE_USER:
+		return openai.ChatMessageRoleUser, nil
+	case pb.ChatCompletionMessageRole_CHAT_COMPLETION_MESSAGE_ROLE_ASSISTANT:
+		return openai.ChatMessageRoleAssistant, nil
+	case pb.ChatCompletionMessageRole_CHAT_COMPLETION_MESSAGE_ROLE_TOOL:
+		return openai.ChatMessageRoleTool, nil
+	default:
+		return "", pb.ErrorInvalidRole("role: %s", role.String())
+	}
+}
+
+// convertMessages validates the request messages and converts them to OpenAI chat messages.
+func convertMessages(messages []*pb.ChatCompletionMessage) ([]openai.ChatCompletionMessage, error) {
+	res := make([]openai.ChatCompletionMessage, 0, len(messages))
+
+	for i, v := range messages {
+		role, err := roleToString(v.GetRole())
+		if err != nil {
+			return nil, err
+		}
+		if role == openai.ChatMessageRoleTool && v.GetToolCallId() == "" {
+			return nil, pb.ErrorInvalidParameter("message %d: tool message without tool_call_id", i)
+		}
+		if len(v.GetToolCalls()) > 0 && role != openai.ChatMessageRoleAssistant {
+			return nil, pb.ErrorInvalidParameter("message %d: only assistant messages carry tool_calls", i)
+		}
+
+		msg := openai.ChatCompletionMessage{
+			Role:       role,
+			ToolCallID: v.GetToolCallId(),
+			ToolCalls:  convertToolCalls(v.GetToolCalls()),
+		}
+
+		if len(v.GetParts()) > 0 {
+			if v.GetContent() != "" {
+				return nil, pb.ErrorInvalidParameter("set either content or parts, not both")
+			}
+			if msg.MultiContent, err = convertParts(v.GetParts(), role); err != nil {
+				return nil, err
+			}
+			res = append(res, msg)
+			continue
+		}
+
+		// An assistant turn that only calls tools has no content.
+		msg.Content = sanitizeContent(v.GetContent())
+		if strings.TrimSpace(msg.Content) == "" && len(msg.ToolCalls) == 0 {
+			err := pb.ErrorEmptyContent("content: %s", v.GetContent())
+			return nil, err
+		}
+
+		res = append(res, msg)
+	}
+
+	return res, nil
+}
+
+// convertParts validates multimodal content parts and converts them to OpenAI
+// message parts. Images are only accepted from users and must be http(s) or
+// inline data:image URLs.
+func convertParts(parts []*pb.ChatCompletionContentPart, role string) ([]openai.ChatMessagePart, error) {
+	res := make([]openai.ChatMessagePart, 0, len(parts))
+
+	for i, v := range parts {
+		switch {
+		case v.GetText() != "" && v.GetImageUrl() != "":
+			return nil, pb.ErrorInvalidParameter("part %d sets both text and image_url", i)
+
+		case v.GetImageUrl() != "":
+			url := v.GetImageUrl()
+			if role != openai.ChatMessageRoleUser {
+				return nil, pb.ErrorInvalidParameter("part %d: images are only allowed in user messages", i)
+			}
+			if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "data:image/") {
+				return nil, pb.ErrorInvalidParameter("part %d: image_url must be an http(s) or data:image URL", i)
+			}
+			detail := openai.ImageURLDetail(v.GetDetail())
+			switch detail {
+			case "", openai.ImageURLDetailAuto, openai.ImageURLDetailLow, openai.ImageURLDetailHigh:
+			default:
+				return nil, pb.ErrorInvalidParameter("part %d: detail: %s", i, v.GetDetail())
+			}
+			res = append(res, openai.ChatMessagePart{
+				Type:     openai.ChatMessagePartTypeImageURL,
+				ImageURL: &openai.ChatMessageImageURL{URL: url, Detail: detail},
+			})
+
+		default:
+			text := sanitizeContent(v.GetText())
+			if strings.TrimSpace(text) == "" {
+				return nil, pb.ErrorEmptyContent("part %d: text: %s", i, v.GetText())
+			}
+			res = append(res, openai.ChatMessagePart{
+				Type: openai.ChatMessagePartTypeText,
+				Text: text,
+			})
+		}
+	}
+
+	return res, nil
+}
+
+// sanitizeContent replaces invalid UTF-8, normalizes line endings and drops
+// control characters other than newlines and tabs, which upstream JSON parsers
+// are known to choke on.
+func sanitizeContent(content string) string {
+	content = strings.ToValidUTF8(content, string(utf8.RuneError))
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, content)
+}
+
+// injectSystemPrompt enforces the configured system prompt. It is prepended as a
+// system message, or combined with a leading caller system message according to
+// the configured policy.
+func injectSystemPrompt(messages []openai.ChatCompletionMessage, prompt *conf.Proxy_SystemPrompt) []openai.ChatCompletionMessage {
+	content := strings.TrimSpace(prompt.GetContent())
+	if content == "" {
+		return messages
+	}
+
+	if len(messages) > 0 && messages[0].Role == openai.ChatMessageRoleSystem {
+		first := messages[0]
+		switch {
+		case prompt.GetPolicy() == conf.Proxy_SystemPrompt_REPLACE:
+			first.Content, first.MultiContent = content, nil
+		case len(first.MultiContent) > 0:
+			first.MultiContent = append([]openai.ChatMessagePart{{
+				Type: openai.ChatMessagePartTypeText,
+				Text: content + "\n\n",
+			}}, first.MultiContent...)
+		default:
+			first.Content = content + "\n\n" + first.Content
+		}
+		return append([]openai.ChatCompletionMessage{first}, messages[1:]...)
+	}
+
+	return append([]openai.ChatCompletionMessage{{
+		Role:    openai.ChatMessageRoleSystem,
+		Content: content,
+	}}, messages...)
+}
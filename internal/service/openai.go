@@ -4,149 +4,694 @@ import (
 	"context"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/go-kratos/kratos/v2/errors"
+	"github.com/go-kratos/kratos/v2/log"
 	"io"
+	"net/http"
+	"runtime"
+	"slices"
 	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	openai "github.com/sashabaranov/go-openai"
+	"google.golang.org/protobuf/proto"
 
 	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/auth"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+const (
+	defaultStreamBufferSize  = 64
+	defaultStreamSendTimeout = 30 * time.Second
+	defaultStreamMaxDuration = 10 * time.Minute
+	// defaultStreamMaxChunkSize keeps each message well below the 4 MB gRPC default.
+	defaultStreamMaxChunkSize = 1 << 20
 )
 
 type OpenAIService struct {
 	pb.UnimplementedOpenAIServer
+
+	streamBufferSize   int
+	streamSendTimeout  time.Duration
+	streamMaxChunkSize int
+	// streamCoalesceWindow batches consecutive chunks to reduce per-message
+	// framing overhead, e.g. behind gRPC-web proxies. Zero disables it.
+	streamCoalesceWindow time.Duration
+	streamMaxDuration    time.Duration
+	// streamSkipWhitespace drops whitespace-only deltas. Off by default since
+	// whitespace is significant in code output.
+	streamSkipWhitespace bool
+
+	rt *RuntimeConfig
+
+	httpClient      *http.Client
+	baseURL         string
+	upstreamTimeout time.Duration
+	interceptors    []ResponseInterceptor
+
+	streams *streamRegistry
+	limiter *streamLimiter
+	quota   *quota
+
+	accessLog *accessLog
+	cache     *responseCache
+
+	clock Clock
+	log   *log.Helper
+}
+
+// Option configures an OpenAIService.
+type Option func(*OpenAIService)
+
+// WithClock replaces the system clock, e.g. to drive timeouts from tests.
+func WithClock(clock Clock) Option {
+	return func(s *OpenAIService) {
+		s.clock = clock
+	}
 }
 
-func NewOpenAIService() *OpenAIService {
-	return &OpenAIService{}
+func NewOpenAIService(c *conf.Proxy, rt *RuntimeConfig, httpClient *http.Client, interceptors []ResponseInterceptor, quotaStore QuotaStore, logger log.Logger, opts ...Option) *OpenAIService {
+	s := &OpenAIService{
+		streamBufferSize:   defaultStreamBufferSize,
+		streamSendTimeout:  defaultStreamSendTimeout,
+		streamMaxChunkSize: defaultStreamMaxChunkSize,
+		streamMaxDuration:  defaultStreamMaxDuration,
+		rt:                 rt,
+		httpClient:         httpClient,
+		baseURL:            c.GetUpstream().GetBaseUrl(),
+		upstreamTimeout:    c.GetUpstream().GetTimeout().AsDuration(),
+		interceptors:       interceptors,
+		streams:            newStreamRegistry(),
+		limiter:            newStreamLimiter(c.GetConcurrency()),
+		accessLog:          &accessLog{},
+		clock:              SystemClock,
+		log:                log.NewHelper(logger),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.quota = &quota{store: quotaStore, rt: rt, clock: s.clock}
+	s.cache = newResponseCache(c.GetCache(), s.clock)
+	if stream := c.GetStream(); stream != nil {
+		if stream.GetBufferSize() > 0 {
+			s.streamBufferSize = int(stream.GetBufferSize())
+		}
+		if stream.GetSendTimeout().AsDuration() > 0 {
+			s.streamSendTimeout = stream.GetSendTimeout().AsDuration()
+		}
+		if stream.GetMaxChunkSize() > 0 {
+			s.streamMaxChunkSize = int(stream.GetMaxChunkSize())
+		}
+		s.streamCoalesceWindow = stream.GetCoalesceWindow().AsDuration()
+		s.streamSkipWhitespace = stream.GetSkipWhitespaceChunks()
+		if stream.GetMaxDuration().AsDuration() > 0 {
+			s.streamMaxDuration = stream.GetMaxDuration().AsDuration()
+		}
+	}
+	return s
 }
 
 func (s *OpenAIService) ChatCompletion(ctx context.Context, req *pb.ChatCompletionRequest) (*pb.ChatCompletionResponse, error) {
-	cfg := openai.DefaultConfig(req.GetToken())
-	cfg.BaseURL = req.GetUrl()
+	rt := s.rt.load()
+	if err := rt.limits.check(proto.Size(req), req.GetMessages()); err != nil {
+		return nil, err
+	}
+	if err := s.checkSampling(ctx, req.GetTemperature(), req.GetTopP()); err != nil {
+		return nil, err
+	}
+	if err := checkStop(req.GetStop()); err != nil {
+		return nil, err
+	}
+	if req.MaxOutputTokens != nil && req.GetMaxOutputTokens() <= 0 {
+		return nil, pb.ErrorInvalidParameter("max_output_tokens must be positive, got %d", req.GetMaxOutputTokens())
+	}
+	ctx, err := withExtraParams(ctx, req.GetExtraParams())
+	if err != nil {
+		return nil, err
+	}
+
+	caller, _ := auth.FromContext(ctx)
+	token, err := rt.vault.resolve(req.GetToken(), req.GetTokenRef(), caller, req.GetUrl())
+	if err != nil {
+		return nil, err
+	}
 
-	client := openai.NewClientWithConfig(cfg)
+	client := s.newClient(req.GetUrl(), token)
+
+	messages, err := convertMessages(req.GetMessages())
+	if err != nil {
+		return nil, err
+	}
+	messages = injectSystemPrompt(messages, rt.systemPrompt)
+	tools, toolChoice, err := convertTools(req.GetTools(), req.GetToolChoice())
+	if err != nil {
+		return nil, err
+	}
+	responseFormat, err := convertResponseFormat(req.GetJsonSchema())
+	if err != nil {
+		return nil, err
+	}
+
+	key := cacheKey(req, caller, token)
+	if res, ok := s.cache.get(key); ok {
+		return res, nil
+	}
+
+	models := rt.resolveModels(req.GetModel(), req.GetFallbackModels())
+	if err := s.quota.check(ctx, caller, estimatePromptTokens(messages, models[0])); err != nil {
+		return nil, err
+	}
 
 	request := openai.ChatCompletionRequest{
-		Model:       req.GetModel(),
-		Messages:    make([]openai.ChatCompletionMessage, 0),
-		Temperature: req.GetTemperature(),
-		TopP:        req.GetTopP(),
-	}
-
-	for _, v := range req.GetMessages() {
-		var role string
-		switch v.GetRole() {
-		case pb.ChatCompletionMessageRole_CHAT_COMPLETION_MESSAGE_ROLE_UNSPECIFIED:
-			err := pb.ErrorInvalidRole("role: %s", v.GetRole().String())
-			return nil, err
-		case pb.ChatCompletionMessageRole_CHAT_COMPLETION_MESSAGE_ROLE_SYSTEM:
-			role = openai.ChatMessageRoleSystem
-		case pb.ChatCompletionMessageRole_CHAT_COMPLETION_MESSAGE_ROLE_USER:
-			role = openai.ChatMessageRoleUser
-		case pb.ChatCompletionMessageRole_CHAT_COMPLETION_MESSAGE_ROLE_ASSISTANT:
-			role = openai.ChatMessageRoleAssistant
-		}
-
-		content := strings.TrimSpace(v.GetContent())
-		if content == "" {
-			err := pb.ErrorEmptyContent("content: %s", v.GetContent)
-			return nil, err
-		}
-
-		request.Messages = append(request.Messages, openai.ChatCompletionMessage{
-			Role:    role,
-			Content: v.GetContent(),
-		})
+		Model:               models[0],
+		Messages:            messages,
+		Stop:                req.GetStop(),
+		Seed:                seed(req.Seed),
+		MaxCompletionTokens: int(req.GetMaxOutputTokens()),
+		Tools:               tools,
+		ToolChoice:          toolChoice,
+		ResponseFormat:      responseFormat,
 	}
+	zeros := s.applyPreset(&request, req.Temperature, req.TopP)
+
+	upstreamCtx, cancel := s.withUpstreamTimeout(withBodyParams(ctx, zeros))
+	defer cancel()
+	upstreamCtx, up := withUpstreamResponse(upstreamCtx)
 
-	response, err := client.CreateChatCompletion(ctx, request)
+	var response openai.ChatCompletionResponse
+	model, err := s.withFallback(ctx, models, func(model string) error {
+		request.Model = model
+		response, err = client.CreateChatCompletion(upstreamCtx, request)
+		return err
+	})
 	if err != nil {
-		err := pb.ErrorOpenaiError("CreateChatCompletion error: %s", err.Error())
-		return nil, err
+		if upstreamCtx.Err() != nil && ctx.Err() == nil {
+			return nil, context.Cause(upstreamCtx)
+		}
+		return nil, upstreamError(err, up, "CreateChatCompletion error: %s")
+	}
+
+	if err := s.quota.debit(ctx, caller, response.Usage.TotalTokens); err != nil {
+		s.log.WithContext(ctx).Errorf("debit quota for %s: %v", caller, err)
 	}
 
 	if len(response.Choices) == 0 {
-		err := pb.ErrorNoChoice("", nil)
+		err := pb.ErrorNoChoice("")
 		err = err.WithMetadata(map[string]string{
 			"response": spew.Sdump(response),
 		})
 		return nil, err
 	}
 
-	res := strings.TrimSpace(response.Choices[0].Message.Content)
+	res := &pb.ChatCompletionResponse{
+		Content:   strings.TrimSpace(response.Choices[0].Message.Content),
+		Model:     model,
+		Usage:     convertUsage(&response.Usage),
+		ToolCalls: toolCallsToProto(response.Choices[0].Message.ToolCalls),
+		Refusal:   response.Choices[0].Message.Refusal,
+	}
+	s.cache.add(key, res)
 
-	return &pb.ChatCompletionResponse{
-		Content: res,
-	}, nil
+	return res, nil
+}
+func (s *OpenAIService) StreamChatCompletion(req *pb.StreamChatCompletionRequest, conn pb.OpenAI_StreamChatCompletionServer) (err error) {
+	stats := &streamStats{
+		OpenAI_StreamChatCompletionServer: conn,
+		clock:                             s.clock,
+		start:                             s.clock.Now(),
+	}
+	// The kratos recovery middleware only covers unary calls.
+	defer func() {
+		if r := recover(); r != nil {
+			err = s.recovered(stats.Context(), r)
+		}
+		s.logStream(req, stats, err)
+	}()
+	return s.streamChatCompletion(req, stats)
 }
-func (s *OpenAIService) StreamChatCompletion(req *pb.StreamChatCompletionRequest, conn pb.OpenAI_StreamChatCompletionServer) error {
-	cfg := openai.DefaultConfig(req.GetToken())
-	cfg.BaseURL = req.GetUrl()
 
-	client := openai.NewClientWithConfig(cfg)
+func (s *OpenAIService) streamChatCompletion(req *pb.StreamChatCompletionRequest, conn *streamStats) error {
+	rt := s.rt.load()
+	if err := rt.limits.check(proto.Size(req), req.GetMessages()); err != nil {
+		return err
+	}
+	if err := s.checkSampling(conn.Context(), req.GetTemperature(), req.GetTopP()); err != nil {
+		return err
+	}
+	if err := checkStop(req.GetStop()); err != nil {
+		return err
+	}
+	if req.MaxOutputTokens != nil && req.GetMaxOutputTokens() <= 0 {
+		return pb.ErrorInvalidParameter("max_output_tokens must be positive, got %d", req.GetMaxOutputTokens())
+	}
+
+	caller, _ := auth.FromContext(conn.Context())
+	token, err := rt.vault.resolve(req.GetToken(), req.GetTokenRef(), caller, req.GetUrl())
+	if err != nil {
+		return err
+	}
+
+	client := s.newClient(req.GetUrl(), token)
+
+	messages, err := convertMessages(req.GetMessages())
+	if err != nil {
+		return err
+	}
+	messages = injectSystemPrompt(messages, rt.systemPrompt)
+	tools, toolChoice, err := convertTools(req.GetTools(), req.GetToolChoice())
+	if err != nil {
+		return err
+	}
+	responseFormat, err := convertResponseFormat(req.GetJsonSchema())
+	if err != nil {
+		return err
+	}
+
+	models := rt.resolveModels(req.GetModel(), req.GetFallbackModels())
+	promptEstimate := estimatePromptTokens(messages, models[0])
+	if err := s.quota.check(conn.Context(), caller, promptEstimate); err != nil {
+		return err
+	}
+
+	release, err := s.limiter.acquire(caller)
+	if err != nil {
+		return err
+	}
+	defer release()
 
 	request := openai.ChatCompletionRequest{
-		Model:       req.GetModel(),
-		Messages:    make([]openai.ChatCompletionMessage, 0),
-		Temperature: req.GetTemperature(),
-		TopP:        req.GetTopP(),
+		Model:               models[0],
+		Messages:            messages,
+		Stop:                req.GetStop(),
+		Seed:                seed(req.Seed),
+		MaxCompletionTokens: int(req.GetMaxOutputTokens()),
+		Tools:               tools,
+		ToolChoice:          toolChoice,
+		ResponseFormat:      responseFormat,
 	}
+	zeros := s.applyPreset(&request, req.Temperature, req.TopP)
+	request.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
 
-	for _, v := range req.GetMessages() {
-		var role string
-		switch v.GetRole() {
-		case pb.ChatCompletionMessageRole_CHAT_COMPLETION_MESSAGE_ROLE_UNSPECIFIED:
-			err := pb.ErrorInvalidRole("role: %s", v.GetRole().String())
-			return err
-		case pb.ChatCompletionMessageRole_CHAT_COMPLETION_MESSAGE_ROLE_SYSTEM:
-			role = openai.ChatMessageRoleSystem
-		case pb.ChatCompletionMessageRole_CHAT_COMPLETION_MESSAGE_ROLE_USER:
-			role = openai.ChatMessageRoleUser
-		case pb.ChatCompletionMessageRole_CHAT_COMPLETION_MESSAGE_ROLE_ASSISTANT:
-			role = openai.ChatMessageRoleAssistant
-		}
+	// Bound the whole stream, independent of any idle timeout, so an upstream
+	// trickling bytes forever cannot hold it open.
+	ctx, cancelTimeout := withTimeoutCause(conn.Context(), s.clock, s.streamMaxDuration,
+		pb.ErrorStreamTimeout("stream exceeded max duration %s", s.streamMaxDuration))
+	defer cancelTimeout()
 
-		content := strings.TrimSpace(v.GetContent())
-		if content == "" {
-			err := pb.ErrorEmptyContent("content: %s", v.GetContent)
-			return err
-		}
+	ctx, cancelUpstream := s.withUpstreamTimeout(ctx)
+	defer cancelUpstream()
 
-		request.Messages = append(request.Messages, openai.ChatCompletionMessage{
-			Role:    role,
-			Content: v.GetContent(),
-		})
+	ctx, cancelCause := context.WithCancelCause(ctx)
+	cancel := func() { cancelCause(nil) }
+	defer cancel()
+
+	ctx, up := withUpstreamResponse(ctx)
+	conn.upstream = up
+	ctx, err = withExtraParams(ctx, req.GetExtraParams())
+	if err != nil {
+		return err
 	}
+	ctx = withBodyParams(ctx, zeros)
 
-	chatCompletionStream, err := client.CreateChatCompletionStream(context.TODO(), request)
+	remove, err := s.streams.add(req.GetRequestId(), &streamEntry{
+		cancel: cancelCause,
+		caller: caller,
+		model:  models[0],
+		stats:  conn,
+	})
 	if err != nil {
-		err := pb.ErrorOpenaiError("CreateChatCompletionStream error: %s", err.Error())
 		return err
 	}
+	defer remove()
+
+	var (
+		chatCompletionStream chatStream
+		model                string
+	)
+	if req.GetRace() && len(models) > 1 {
+		model, chatCompletionStream, err = s.raceStreams(ctx, client, request, models)
+		request.Model = model
+	} else {
+		model, err = s.withFallback(ctx, models, func(model string) error {
+			request.Model = model
+			chatCompletionStream, err = client.CreateChatCompletionStream(ctx, request)
+			return err
+		})
+	}
+	if err != nil {
+		// A timeout or CancelStream that hits before the stream opens reports
+		// why, like one that hits mid-stream.
+		if ctx.Err() != nil && conn.Context().Err() == nil {
+			err = context.Cause(ctx)
+			s.sendError(conn, models[0], err)
+			return err
+		}
+		return upstreamError(err, up, "CreateChatCompletionStream error: %s")
+	}
 
 	defer chatCompletionStream.Close()
 
-	for {
-		response, err := chatCompletionStream.Recv()
-		if errors.Is(err, io.EOF) {
-			return nil
+	// streamed counts the completion bytes read so far. A stream that ends
+	// without reported usage (error, timeout, cancel, client gone) has still
+	// consumed upstream tokens, so it is charged an estimate instead.
+	var (
+		streamed atomic.Int64
+		debited  bool
+	)
+	defer func() {
+		if debited {
+			return
+		}
+		tokens := promptEstimate + estimateCompletionTokens(streamed.Load())
+		if err := s.quota.debit(context.WithoutCancel(ctx), caller, tokens); err != nil {
+			s.log.WithContext(ctx).Errorf("debit quota for %s: %v", caller, err)
+		}
+	}()
+
+	s.startShadow(ctx, client, request, caller)
+
+	// chunks decouples the upstream read loop from conn.Send, so a slow client
+	// can only hold streamBufferSize chunks in memory before the stream is aborted.
+	chunks := make(chan string, s.streamBufferSize)
+	errc := make(chan error, 1)
+	// usage, toolCalls and refusal are only written by the read loop before it
+	// closes chunks.
+	var (
+		usage     *openai.Usage
+		toolCalls toolCallAccumulator
+		refusal   strings.Builder
+	)
+
+	go func() {
+		defer close(chunks)
+		defer func() {
+			if r := recover(); r != nil {
+				errc <- s.recovered(ctx, r)
+			}
+		}()
+
+		for {
+			response, err := chatCompletionStream.Recv()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+
+			if err != nil {
+				// The stream was cancelled; the handler reports why.
+				if ctx.Err() != nil {
+					return
+				}
+				errc <- upstreamError(err, up, "receive stream error: %s")
+				return
+			}
+
+			// With include_usage the final chunk carries usage and no choices.
+			if len(response.Choices) == 0 && response.Usage != nil {
+				usage = response.Usage
+				continue
+			}
+
+			if len(response.Choices) == 0 {
+				err := pb.ErrorNoChoice("")
+				err = err.WithMetadata(map[string]string{
+					"response": spew.Sdump(response),
+				})
+				errc <- err
+				return
+			}
+
+			delta := response.Choices[0].Delta
+			streamed.Add(int64(len(delta.Content) + len(delta.Refusal)))
+			for _, call := range delta.ToolCalls {
+				streamed.Add(int64(len(call.Function.Arguments)))
+			}
+			toolCalls.add(delta.ToolCalls)
+			refusal.WriteString(delta.Refusal)
+			content := delta.Content
+			if content == "" && (len(delta.ToolCalls) > 0 || delta.Refusal != "") {
+				continue
+			}
+			if s.streamSkipWhitespace && strings.TrimSpace(content) == "" {
+				continue
+			}
+
+			select {
+			case chunks <- content:
+				continue
+			default:
+			}
+
+			select {
+			case chunks <- content:
+			case <-s.clock.After(s.streamSendTimeout):
+				s.log.WithContext(ctx).Warnf("stream buffer full for %s, aborting stream", s.streamSendTimeout)
+				errc <- pb.ErrorSendTimeout("client did not consume stream within %s", s.streamSendTimeout)
+				cancel()
+				return
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
 
-		if err != nil {
-			err := pb.ErrorOpenaiError("receive stream error: %s", err.Error())
+	for chunk := range chunks {
+		if s.streamCoalesceWindow > 0 {
+			chunk = coalesceChunks(chunk, chunks, s.clock.After(s.streamCoalesceWindow))
+		}
+
+		for _, part := range splitChunk(chunk, s.streamMaxChunkSize) {
+			if err := s.send(ctx, conn, &pb.StreamChatCompletionResponse{
+				Chunk: part,
+				Model: model,
+			}); err != nil {
+				cancel()
+				return err
+			}
+		}
+	}
+
+	select {
+	case err := <-errc:
+		s.sendError(conn, model, err)
+		return err
+	default:
+	}
+
+	if len(toolCalls.calls) > 0 || refusal.Len() > 0 {
+		if err := s.send(ctx, conn, &pb.StreamChatCompletionResponse{
+			Model:     model,
+			ToolCalls: toolCallsToProto(toolCalls.calls),
+			Refusal:   refusal.String(),
+		}); err != nil {
 			return err
 		}
+	}
+
+	if usage != nil {
+		debited = true
+		if err := s.quota.debit(ctx, caller, usage.TotalTokens); err != nil {
+			s.log.WithContext(ctx).Errorf("debit quota for %s: %v", caller, err)
+		}
 
-		if len(response.Choices) == 0 {
-			err := pb.ErrorNoChoice("", nil)
-			err = err.WithMetadata(map[string]string{
-				"response": spew.Sdump(response),
-			})
+		if err := s.send(ctx, conn, &pb.StreamChatCompletionResponse{
+			Model: model,
+			Usage: convertUsage(usage),
+		}); err != nil {
 			return err
 		}
+	}
 
-		conn.Send(&pb.StreamChatCompletionResponse{
-			Chunk: response.Choices[0].Delta.Content,
+	// A stream cancelled through CancelStream or cut off by a timeout reports
+	// why it ended.
+	if cause := context.Cause(ctx); cause != nil && conn.Context().Err() == nil {
+		s.sendError(conn, model, cause)
+		return cause
+	}
+	return nil
+}
+
+// sendError sends err as a final in-band event so clients can render the
+// failure next to partial output. It is skipped when the client is not reading.
+func (s *OpenAIService) sendError(conn pb.OpenAI_StreamChatCompletionServer, model string, err error) {
+	if pb.IsSendTimeout(err) {
+		return
+	}
+	se := errors.FromError(err)
+	if sendErr := conn.Send(&pb.StreamChatCompletionResponse{
+		Model: model,
+		Error: &pb.StreamError{
+			Reason:  se.Reason,
+			Message: se.Message,
+		},
+	}); sendErr != nil {
+		s.log.WithContext(conn.Context()).Warnf("send stream error event: %v", sendErr)
+	}
+}
+
+// recovered logs a recovered panic with its stack and converts it into an
+// error for the client, keeping the process alive.
+func (s *OpenAIService) recovered(ctx context.Context, r interface{}) error {
+	buf := make([]byte, 64<<10)
+	buf = buf[:runtime.Stack(buf, false)]
+	s.log.WithContext(ctx).Errorf("panic in stream: %v\n%s", r, buf)
+	return pb.ErrorInternalError("internal error")
+}
+
+// send passes res through the interceptor chain and writes it to the client.
+func (s *OpenAIService) send(ctx context.Context, conn pb.OpenAI_StreamChatCompletionServer, res *pb.StreamChatCompletionResponse) error {
+	res, err := s.intercept(ctx, res)
+	if err != nil || res == nil {
+		return err
+	}
+	return conn.Send(res)
+}
+
+// model returns the configured entry for name, or nil.
+func (s *OpenAIService) model(name string) *conf.Proxy_Model {
+	for _, m := range s.rt.load().models {
+		if m.GetName() == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// seed converts an optional proto seed to the go-openai field.
+func seed(v *int64) *int {
+	if v == nil {
+		return nil
+	}
+	n := int(*v)
+	return &n
+}
+
+// applyPreset sets the sampling parameters on request, filling those the
+// caller left unset from the requested model's configured defaults. go-openai
+// omits zero values, so explicit zeros are returned as body params for
+// extraParamsTransport to add.
+func (s *OpenAIService) applyPreset(request *openai.ChatCompletionRequest, temperature, topP *float32) map[string]interface{} {
+	m := s.model(request.Model)
+	zeros := make(map[string]interface{})
+	set := func(field *float32, key string, v *float32, preset float32) {
+		switch {
+		case v == nil:
+			*field = preset
+		case *v == 0:
+			zeros[key] = 0
+		default:
+			*field = *v
+		}
+	}
+	set(&request.Temperature, "temperature", temperature, m.GetTemperature())
+	set(&request.TopP, "top_p", topP, m.GetTopP())
+	return zeros
+}
+
+func (s *OpenAIService) ListModels(ctx context.Context, req *pb.ListModelsRequest) (*pb.ListModelsResponse, error) {
+	rt := s.rt.load()
+	models := make([]*pb.Model, 0, len(rt.models))
+	for _, m := range rt.models {
+		models = append(models, &pb.Model{
+			Name:              m.GetName(),
+			SupportsReasoning: m.GetSupportsReasoning(),
+			MaxContextTokens:  m.GetMaxContextTokens(),
 		})
 	}
+	return &pb.ListModelsResponse{
+		Models: models,
+	}, nil
+}
+
+// ValidateToken checks the upstream token with a model listing, the cheapest
+// authenticated call, so no completion is billed.
+func (s *OpenAIService) ValidateToken(ctx context.Context, req *pb.ValidateTokenRequest) (*pb.ValidateTokenResponse, error) {
+	caller, _ := auth.FromContext(ctx)
+	token, err := s.rt.load().vault.resolve(req.GetToken(), req.GetTokenRef(), caller, req.GetUrl())
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamCtx, cancel := s.withUpstreamTimeout(ctx)
+	defer cancel()
+	upstreamCtx, up := withUpstreamResponse(upstreamCtx)
+
+	if _, err := s.newClient(req.GetUrl(), token).ListModels(upstreamCtx); err != nil {
+		if upstreamCtx.Err() != nil && ctx.Err() == nil {
+			return nil, context.Cause(upstreamCtx)
+		}
+		e := upstreamError(err, up, "ListModels error: %s")
+		switch e.Metadata["upstream_status"] {
+		case "401":
+			return nil, pb.ErrorUpstreamUnauthenticated("upstream rejected token").WithMetadata(e.Metadata)
+		case "403":
+			return nil, pb.ErrorUpstreamForbidden("upstream token lacks permission").WithMetadata(e.Metadata)
+		}
+		return nil, e
+	}
+	return &pb.ValidateTokenResponse{}, nil
+}
+
+func (s *OpenAIService) CancelStream(ctx context.Context, req *pb.CancelStreamRequest) (*pb.CancelStreamResponse, error) {
+	// Without authentication there are no callers to tell apart.
+	caller, ok := auth.FromContext(ctx)
+	admin := !ok || slices.Contains(s.rt.load().admins, caller)
+	if err := s.streams.cancel(req.GetRequestId(), caller, admin); err != nil {
+		return nil, err
+	}
+	return &pb.CancelStreamResponse{}, nil
+}
+
+func (s *OpenAIService) ListStreams(ctx context.Context, req *pb.ListStreamsRequest) (*pb.ListStreamsResponse, error) {
+	if caller, ok := auth.FromContext(ctx); ok && !slices.Contains(s.rt.load().admins, caller) {
+		return nil, pb.ErrorForbidden("caller %s is not an admin", caller)
+	}
+	return &pb.ListStreamsResponse{
+		Streams: s.streams.list(),
+	}, nil
+}
+
+// coalesceChunks appends chunks arriving after first until window fires. It
+// returns early when chunks is closed.
+func coalesceChunks(first string, chunks <-chan string, window <-chan time.Time) string {
+	var b strings.Builder
+	b.WriteString(first)
+
+	for {
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				return b.String()
+			}
+			b.WriteString(chunk)
+		case <-window:
+			return b.String()
+		}
+	}
+}
+
+// splitChunk splits chunk into parts of at most size bytes without breaking
+// multi-byte UTF-8 characters.
+func splitChunk(chunk string, size int) []string {
+	if len(chunk) <= size {
+		return []string{chunk}
+	}
+
+	parts := make([]string, 0, len(chunk)/size+1)
+	for len(chunk) > size {
+		end := size
+		for end > 0 && !utf8.RuneStart(chunk[end]) {
+			end--
+		}
+		if end == 0 {
+			_, end = utf8.DecodeRuneInString(chunk)
+		}
+		parts = append(parts, chunk[:end])
+		chunk = chunk[end:]
+	}
+	if chunk != "" {
+		parts = append(parts, chunk)
+	}
+	return parts
 }
@@ -0,0 +1,849 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-kratos/kratos/v2/errors"
+	"github.com/go-kratos/kratos/v2/log"
+	openai "github.com/sashabaranov/go-openai"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+// fakeStream is the server side of a StreamChatCompletion call.
+type fakeStream struct {
+	ctx context.Context
+
+	mu  sync.Mutex
+	got []*pb.StreamChatCompletionResponse
+}
+
+func newFakeStream(ctx context.Context) *fakeStream {
+	return &fakeStream{ctx: ctx}
+}
+
+func (f *fakeStream) Send(r *pb.StreamChatCompletionResponse) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.got = append(f.got, r)
+	return nil
+}
+
+func (f *fakeStream) responses() []*pb.StreamChatCompletionResponse {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*pb.StreamChatCompletionResponse(nil), f.got...)
+}
+
+// content joins the chunks received so far.
+func (f *fakeStream) content() string {
+	var b strings.Builder
+	for _, r := range f.responses() {
+		b.WriteString(r.GetChunk())
+	}
+	return b.String()
+}
+
+func (f *fakeStream) SetHeader(metadata.MD) error  { return nil }
+func (f *fakeStream) SendHeader(metadata.MD) error { return nil }
+func (f *fakeStream) SetTrailer(metadata.MD)       {}
+func (f *fakeStream) Context() context.Context     { return f.ctx }
+func (f *fakeStream) SendMsg(any) error            { return nil }
+func (f *fakeStream) RecvMsg(any) error            { return nil }
+
+// writeSSE streams deltas as chat completion chunks followed by usage and the
+// terminating [DONE] event.
+func writeSSE(w http.ResponseWriter, model string, deltas ...string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, d := range deltas {
+		b, _ := json.Marshal(map[string]any{
+			"model":   model,
+			"choices": []any{map[string]any{"delta": map[string]any{"content": d}}},
+		})
+		fmt.Fprintf(w, "data: %s\n\n", b)
+		w.(http.Flusher).Flush()
+	}
+	fmt.Fprintf(w, "data: {\"model\":%q,\"choices\":[],\"usage\":{\"prompt_tokens\":1,\"completion_tokens\":1,\"total_tokens\":2}}\n\n", model)
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+func newTestService(t *testing.T, c *conf.Proxy, opts ...Option) *OpenAIService {
+	t.Helper()
+	httpClient, err := NewHTTPClient(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewOpenAIService(c, NewRuntimeConfig(c), httpClient, nil, NewQuotaStore(), log.DefaultLogger, opts...)
+}
+
+func streamRequest(url, model string) *pb.StreamChatCompletionRequest {
+	return &pb.StreamChatCompletionRequest{
+		Url:      url,
+		Model:    model,
+		Messages: []*pb.ChatCompletionMessage{{Role: pb.ChatCompletionMessageRole_CHAT_COMPLETION_MESSAGE_ROLE_USER, Content: "hi"}},
+	}
+}
+
+func TestSplitChunk(t *testing.T) {
+	tests := []struct {
+		name  string
+		chunk string
+		size  int
+		want  []string
+	}{
+		{"fits", "hello", 5, []string{"hello"}},
+		{"ascii", "hello", 2, []string{"he", "ll", "o"}},
+		{"never splits a rune", "a世界", 3, []string{"a", "世", "界"}},
+		{"rune larger than size", "世界", 2, []string{"世", "界"}},
+		{"empty", "", 4, []string{""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitChunk(tt.chunk, tt.size)
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitChunkLargeMultiByte(t *testing.T) {
+	const size = 1 << 20
+	// 4-, 3- and 2-byte runes misaligned against size on purpose.
+	chunk := strings.Repeat("😀中é", 5<<20/9)
+
+	parts := splitChunk(chunk, size)
+	if len(parts) < 5 {
+		t.Fatalf("got %d parts, want at least 5", len(parts))
+	}
+	for i, p := range parts {
+		if len(p) > size {
+			t.Fatalf("part %d has %d bytes, exceeds %d", i, len(p), size)
+		}
+		if !utf8.ValidString(p) {
+			t.Fatalf("part %d splits a multi-byte character", i)
+		}
+	}
+	if strings.Join(parts, "") != chunk {
+		t.Fatal("parts do not reassemble into the original chunk")
+	}
+}
+
+func TestStreamSplitsOversizedChunk(t *testing.T) {
+	content := strings.Repeat("世界", 5<<20/6)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeSSE(w, "gpt-4o", content)
+	}))
+	defer upstream.Close()
+
+	s := newTestService(t, &conf.Proxy{})
+	stream := newFakeStream(context.Background())
+	if err := s.StreamChatCompletion(streamRequest(upstream.URL, "gpt-4o"), stream); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := 0
+	for _, r := range stream.responses() {
+		if r.GetChunk() == "" {
+			continue
+		}
+		chunks++
+		if len(r.GetChunk()) > defaultStreamMaxChunkSize {
+			t.Fatalf("chunk of %d bytes exceeds %d", len(r.GetChunk()), defaultStreamMaxChunkSize)
+		}
+		if !utf8.ValidString(r.GetChunk()) {
+			t.Fatal("chunk splits a multi-byte character")
+		}
+	}
+	if chunks < 5 {
+		t.Fatalf("got %d chunks, want at least 5", chunks)
+	}
+	if stream.content() != content {
+		t.Fatal("content did not arrive intact")
+	}
+}
+
+// waitForContent blocks until the client has received want.
+func waitForContent(t *testing.T, stream *fakeStream, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for stream.content() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("content = %q, want %q", stream.content(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// lastError returns the in-band error event that ended the stream.
+func (f *fakeStream) lastError() *pb.StreamError {
+	got := f.responses()
+	if len(got) == 0 {
+		return nil
+	}
+	return got[len(got)-1].GetError()
+}
+
+// hangingUpstream sends deltas, then holds the stream open without finishing
+// it until the test ends.
+func hangingUpstream(t *testing.T, deltas ...string) *httptest.Server {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(deltas) > 0 {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, d := range deltas {
+				fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%q}}]}\n\n", d)
+			}
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	t.Cleanup(func() { close(release) })
+	return upstream
+}
+
+func TestStreamUpstreamTimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		deltas []string
+	}{
+		{"before the stream opens", nil},
+		{"mid-stream", []string{"slow ", "answer"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := hangingUpstream(t, tt.deltas...)
+			clock := newFakeClock()
+			s := newTestService(t, &conf.Proxy{Upstream: &conf.Proxy_Upstream{Timeout: durationpb.New(time.Minute)}}, WithClock(clock))
+
+			stream := newFakeStream(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- s.StreamChatCompletion(streamRequest(upstream.URL, "gpt-4o"), stream) }()
+			// max_duration and upstream.timeout
+			clock.waitForWaiters(t, 2)
+			waitForContent(t, stream, strings.Join(tt.deltas, ""))
+
+			clock.Advance(time.Minute)
+			select {
+			case err := <-done:
+				if !pb.IsUpstreamTimeout(err) {
+					t.Fatalf("err = %v, want UPSTREAM_TIMEOUT", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("stream did not end at the upstream timeout")
+			}
+			if e := stream.lastError(); e.GetReason() != pb.ErrorReason_UPSTREAM_TIMEOUT.String() {
+				t.Fatalf("terminal event = %v, want UPSTREAM_TIMEOUT", e)
+			}
+		})
+	}
+}
+
+func TestStreamMaxDurationBeforeStreamOpens(t *testing.T) {
+	upstream := hangingUpstream(t)
+	clock := newFakeClock()
+	s := newTestService(t, &conf.Proxy{}, WithClock(clock))
+
+	stream := newFakeStream(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.StreamChatCompletion(streamRequest(upstream.URL, "gpt-4o"), stream) }()
+	clock.waitForWaiters(t, 1)
+
+	clock.Advance(defaultStreamMaxDuration)
+	if err := <-done; !pb.IsStreamTimeout(err) {
+		t.Fatalf("err = %v, want STREAM_TIMEOUT", err)
+	}
+	if e := stream.lastError(); e.GetReason() != pb.ErrorReason_STREAM_TIMEOUT.String() {
+		t.Fatalf("terminal event = %v, want STREAM_TIMEOUT", e)
+	}
+}
+
+func TestCancelStreamBeforeStreamOpens(t *testing.T) {
+	var started atomic.Bool
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started.Store(true)
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	s := newTestService(t, &conf.Proxy{})
+	req := streamRequest(upstream.URL, "gpt-4o")
+	req.RequestId = "req-1"
+	stream := newFakeStream(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.StreamChatCompletion(req, stream) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !started.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("upstream request not sent")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := s.CancelStream(context.Background(), &pb.CancelStreamRequest{RequestId: "req-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; !pb.IsStreamCancelled(err) {
+		t.Fatalf("err = %v, want STREAM_CANCELLED", err)
+	}
+	if e := stream.lastError(); e.GetReason() != pb.ErrorReason_STREAM_CANCELLED.String() {
+		t.Fatalf("terminal event = %v, want STREAM_CANCELLED", e)
+	}
+}
+
+func TestValidateToken(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Header.Get("Authorization") {
+		case "Bearer sk-good":
+			fmt.Fprint(w, `{"object":"list","data":[{"id":"gpt-4o","object":"model"}]}`)
+		case "Bearer sk-readonly":
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"error":{"message":"insufficient permissions"}}`)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":{"message":"invalid api key"}}`)
+		}
+	}))
+	defer upstream.Close()
+
+	s := newTestService(t, &conf.Proxy{})
+	tests := []struct {
+		token   string
+		wantErr func(error) bool
+		status  string
+	}{
+		{token: "sk-good"},
+		{token: "sk-bad", wantErr: pb.IsUpstreamUnauthenticated, status: "401"},
+		{token: "sk-readonly", wantErr: pb.IsUpstreamForbidden, status: "403"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			_, err := s.ValidateToken(context.Background(), &pb.ValidateTokenRequest{Url: upstream.URL, Token: tt.token})
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !tt.wantErr(err) {
+				t.Fatalf("err = %v", err)
+			}
+			// The proxy's own API key checks use different reasons.
+			if pb.IsUnauthenticated(err) || pb.IsForbidden(err) {
+				t.Fatalf("upstream rejection %v is indistinguishable from a proxy one", err)
+			}
+			if got := errors.FromError(err).Metadata["upstream_status"]; got != tt.status {
+				t.Fatalf("upstream_status = %q, want %s", got, tt.status)
+			}
+		})
+	}
+}
+
+// slowStream is a client that stops reading: Send blocks until release is
+// closed.
+type slowStream struct {
+	*fakeStream
+	blocked chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (s *slowStream) Send(r *pb.StreamChatCompletionResponse) error {
+	s.once.Do(func() { close(s.blocked) })
+	<-s.release
+	return s.fakeStream.Send(r)
+}
+
+func TestStreamSendTimeoutCancelsUpstream(t *testing.T) {
+	cancelled := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Drain the body so the server notices when the proxy hangs up.
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 10; i++ {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":\"chunk %d \"}}]}\n\n", i)
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer upstream.Close()
+
+	clock := newFakeClock()
+	s := newTestService(t, &conf.Proxy{Stream: &conf.Proxy_Stream{
+		BufferSize:  2,
+		SendTimeout: durationpb.New(time.Second),
+	}}, WithClock(clock))
+
+	stream := &slowStream{
+		fakeStream: newFakeStream(context.Background()),
+		blocked:    make(chan struct{}),
+		release:    make(chan struct{}),
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.StreamChatCompletion(streamRequest(upstream.URL, "gpt-4o"), stream) }()
+	<-stream.blocked
+
+	// The read loop waits on the send timeout once the buffer is full; keep
+	// advancing until it fires and the upstream request is torn down.
+	deadline := time.Now().Add(5 * time.Second)
+wait:
+	for {
+		select {
+		case <-cancelled:
+			break wait
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("upstream not cancelled after the send timeout")
+		}
+		clock.Advance(time.Second)
+		time.Sleep(time.Millisecond)
+	}
+
+	close(stream.release)
+	if err := <-done; !pb.IsSendTimeout(err) {
+		t.Fatalf("err = %v, want SEND_TIMEOUT", err)
+	}
+	if e := stream.lastError(); e != nil {
+		t.Fatalf("error event %v sent to a client that is not reading", e)
+	}
+	if got := len(stream.responses()); got > 3 {
+		t.Fatalf("client got %d chunks, want at most the one in flight and the buffered 2", got)
+	}
+}
+
+func TestCoalesceChunks(t *testing.T) {
+	clock := newFakeClock()
+	chunks := make(chan string, 8)
+	for _, d := range []string{"b", "c", "d"} {
+		chunks <- d
+	}
+
+	done := make(chan string, 1)
+	go func() { done <- coalesceChunks("a", chunks, clock.After(50*time.Millisecond)) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(chunks) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("buffered deltas not consumed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case got := <-done:
+		t.Fatalf("returned %q before the window closed", got)
+	default:
+	}
+
+	clock.Advance(50 * time.Millisecond)
+	if got := <-done; got != "abcd" {
+		t.Fatalf("got %q, want abcd", got)
+	}
+
+	// Deltas after the window start the next chunk.
+	chunks <- "e"
+	close(chunks)
+	if got := coalesceChunks("", chunks, clock.After(time.Second)); got != "e" {
+		t.Fatalf("after close got %q, want e", got)
+	}
+}
+
+func TestStreamCoalescesDeltas(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeSSE(w, "gpt-4o", "one ", "two ", "three ", "four ", "five")
+	}))
+	defer upstream.Close()
+
+	// The fake clock never fires the window, so every delta lands in the
+	// window opened by the first one and the chunk is flushed when the
+	// upstream finishes.
+	s := newTestService(t, &conf.Proxy{Stream: &conf.Proxy_Stream{CoalesceWindow: durationpb.New(50 * time.Millisecond)}}, WithClock(newFakeClock()))
+	stream := newFakeStream(context.Background())
+	if err := s.StreamChatCompletion(streamRequest(upstream.URL, "gpt-4o"), stream); err != nil {
+		t.Fatal(err)
+	}
+
+	var chunks []string
+	for _, r := range stream.responses() {
+		if r.GetChunk() != "" {
+			chunks = append(chunks, r.GetChunk())
+		}
+	}
+	if len(chunks) != 1 || chunks[0] != "one two three four five" {
+		t.Fatalf("chunks = %q, want the five deltas in one chunk", chunks)
+	}
+}
+
+func TestStreamSkipWhitespaceChunks(t *testing.T) {
+	tests := []struct {
+		name   string
+		skip   bool
+		deltas []string
+		want   []string
+	}{
+		{
+			name:   "code keeps its whitespace",
+			deltas: []string{"func main() {", "\n", "\t", "fmt.Println(1)", "\n", "}"},
+			want:   []string{"func main() {", "\n", "\t", "fmt.Println(1)", "\n", "}"},
+		},
+		{
+			name:   "prose drops whitespace-only deltas",
+			skip:   true,
+			deltas: []string{"Sure", " ", "\n\n", "here it is", "  ", " done\n"},
+			want:   []string{"Sure", "here it is", " done\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeSSE(w, "gpt-4o", tt.deltas...)
+			}))
+			defer upstream.Close()
+
+			s := newTestService(t, &conf.Proxy{Stream: &conf.Proxy_Stream{SkipWhitespaceChunks: tt.skip}})
+			stream := newFakeStream(context.Background())
+			if err := s.StreamChatCompletion(streamRequest(upstream.URL, "gpt-4o"), stream); err != nil {
+				t.Fatal(err)
+			}
+			var chunks []string
+			for _, r := range stream.responses() {
+				if r.GetChunk() != "" {
+					chunks = append(chunks, r.GetChunk())
+				}
+			}
+			if !reflect.DeepEqual(chunks, tt.want) {
+				t.Fatalf("chunks = %q, want %q", chunks, tt.want)
+			}
+		})
+	}
+}
+
+func TestListModels(t *testing.T) {
+	c := &conf.Proxy{Models: []*conf.Proxy_Model{
+		{Name: "gpt-4o", MaxContextTokens: 128000, Temperature: 0.7},
+		{Name: "o1", SupportsReasoning: true, MaxContextTokens: 200000},
+	}}
+	rt := NewRuntimeConfig(c)
+	s := NewOpenAIService(c, rt, http.DefaultClient, nil, NewQuotaStore(), log.DefaultLogger)
+
+	res, err := s.ListModels(context.Background(), &pb.ListModelsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*pb.Model{
+		{Name: "gpt-4o", MaxContextTokens: 128000},
+		{Name: "o1", SupportsReasoning: true, MaxContextTokens: 200000},
+	}
+	if len(res.GetModels()) != len(want) {
+		t.Fatalf("got %v, want %v", res.GetModels(), want)
+	}
+	for i, m := range res.GetModels() {
+		if !proto.Equal(m, want[i]) {
+			t.Fatalf("model %d = %v, want %v", i, m, want[i])
+		}
+	}
+
+	rt.Update(&conf.Proxy{})
+	res, err = s.ListModels(context.Background(), &pb.ListModelsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.GetModels()) != 0 {
+		t.Fatalf("reloaded config without models still lists %v", res.GetModels())
+	}
+}
+
+func TestStreamMaxDurationCutsTricklingUpstream(t *testing.T) {
+	cancelled := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\".\"}}]}\n\n")
+			w.(http.Flusher).Flush()
+			select {
+			case <-ticker.C:
+			case <-r.Context().Done():
+				close(cancelled)
+				return
+			}
+		}
+	}))
+	defer upstream.Close()
+
+	clock := newFakeClock()
+	s := newTestService(t, &conf.Proxy{Stream: &conf.Proxy_Stream{MaxDuration: durationpb.New(30 * time.Second)}}, WithClock(clock))
+	stream := newFakeStream(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.StreamChatCompletion(streamRequest(upstream.URL, "gpt-4o"), stream) }()
+	clock.waitForWaiters(t, 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for stream.content() == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("stream did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	clock.Advance(29 * time.Second)
+	select {
+	case err := <-done:
+		t.Fatalf("stream ended before max_duration: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case err := <-done:
+		if !pb.IsStreamTimeout(err) {
+			t.Fatalf("err = %v, want STREAM_TIMEOUT", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not terminated at max_duration")
+	}
+	if e := stream.lastError(); e.GetReason() != pb.ErrorReason_STREAM_TIMEOUT.String() {
+		t.Fatalf("terminal event = %v, want STREAM_TIMEOUT", e)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request not cancelled")
+	}
+}
+
+func TestApplyPreset(t *testing.T) {
+	s := newTestService(t, &conf.Proxy{Models: []*conf.Proxy_Model{{Name: "gpt-4o", Temperature: 0.7, TopP: 0.9}}})
+	f := func(v float32) *float32 { return &v }
+	tests := []struct {
+		name             string
+		model            string
+		temperature, top *float32
+		wantTemperature  float32
+		wantTop          float32
+		wantZeros        map[string]interface{}
+	}{
+		{name: "unset uses preset", model: "gpt-4o", wantTemperature: 0.7, wantTop: 0.9},
+		{name: "explicit value wins", model: "gpt-4o", temperature: f(0.2), top: f(0.5), wantTemperature: 0.2, wantTop: 0.5},
+		{name: "explicit zero wins", model: "gpt-4o", temperature: f(0), wantTop: 0.9, wantZeros: map[string]interface{}{"temperature": 0}},
+		{name: "both zero", model: "gpt-4o", temperature: f(0), top: f(0), wantZeros: map[string]interface{}{"temperature": 0, "top_p": 0}},
+		{name: "model without preset", model: "o1"},
+		{name: "model without preset keeps explicit value", model: "o1", top: f(0.3), wantTop: 0.3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := openai.ChatCompletionRequest{Model: tt.model}
+			zeros := s.applyPreset(&request, tt.temperature, tt.top)
+			if request.Temperature != tt.wantTemperature || request.TopP != tt.wantTop {
+				t.Fatalf("temperature, top_p = %v, %v; want %v, %v", request.Temperature, request.TopP, tt.wantTemperature, tt.wantTop)
+			}
+			if len(zeros) != len(tt.wantZeros) || (len(zeros) > 0 && !reflect.DeepEqual(zeros, tt.wantZeros)) {
+				t.Fatalf("zeros = %v, want %v", zeros, tt.wantZeros)
+			}
+		})
+	}
+}
+
+func TestPresetReachesUpstream(t *testing.T) {
+	var body atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b map[string]any
+		json.NewDecoder(r.Body).Decode(&b)
+		body.Store(b)
+		writeSSE(w, "gpt-4o", "hi")
+	}))
+	defer upstream.Close()
+
+	s := newTestService(t, &conf.Proxy{Models: []*conf.Proxy_Model{{Name: "gpt-4o", Temperature: 0.5}}})
+	if err := s.StreamChatCompletion(streamRequest(upstream.URL, "gpt-4o"), newFakeStream(context.Background())); err != nil {
+		t.Fatal(err)
+	}
+	if got := body.Load().(map[string]any)["temperature"]; got != 0.5 {
+		t.Fatalf("temperature = %v, want the preset 0.5", got)
+	}
+
+	req := streamRequest(upstream.URL, "gpt-4o")
+	temperature := float32(1.5)
+	req.Temperature = &temperature
+	if err := s.StreamChatCompletion(req, newFakeStream(context.Background())); err != nil {
+		t.Fatal(err)
+	}
+	if got := body.Load().(map[string]any)["temperature"]; got != 1.5 {
+		t.Fatalf("temperature = %v, want the caller's 1.5", got)
+	}
+}
+
+func TestExplicitZeroSamplingReachesUpstream(t *testing.T) {
+	upstream, body := bodyUpstream(t)
+	s := newTestService(t, &conf.Proxy{Models: []*conf.Proxy_Model{{Name: "gpt-4o", Temperature: 0.7, TopP: 0.9}}})
+	f := func(v float32) *float32 { return &v }
+	tests := []struct {
+		name             string
+		model            string
+		temperature, top *float32
+		want             map[string]any
+	}{
+		{name: "zero temperature", model: "gpt-4o", temperature: f(0), want: map[string]any{"temperature": 0.0, "top_p": 0.9}},
+		{name: "zero top_p", model: "gpt-4o", top: f(0), want: map[string]any{"temperature": 0.7, "top_p": 0.0}},
+		{name: "both zero", model: "gpt-4o", temperature: f(0), top: f(0), want: map[string]any{"temperature": 0.0, "top_p": 0.0}},
+		{name: "unset without preset", model: "o1", want: map[string]any{}},
+	}
+	for _, tt := range tests {
+		check := func(t *testing.T) {
+			t.Helper()
+			b := body()
+			got := map[string]any{}
+			for _, key := range []string{"temperature", "top_p"} {
+				if v, ok := b[key]; ok {
+					// Presets are float32, so compare at that precision.
+					got[key] = float64(float32(v.(float64)))
+				}
+			}
+			want := map[string]any{}
+			for k, v := range tt.want {
+				want[k] = float64(float32(v.(float64)))
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("sampling = %v, want %v", got, want)
+			}
+		}
+		t.Run(tt.name+"/unary", func(t *testing.T) {
+			req := &pb.ChatCompletionRequest{Url: upstream.URL, Model: tt.model, Messages: userMessages("hi"), Temperature: tt.temperature, TopP: tt.top}
+			if _, err := s.ChatCompletion(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+			check(t)
+		})
+		t.Run(tt.name+"/stream", func(t *testing.T) {
+			req := streamRequest(upstream.URL, tt.model)
+			req.Temperature, req.TopP = tt.temperature, tt.top
+			if err := s.StreamChatCompletion(req, newFakeStream(context.Background())); err != nil {
+				t.Fatal(err)
+			}
+			check(t)
+		})
+	}
+}
+
+func TestMaxOutputTokensAndSeed(t *testing.T) {
+	i32 := func(v int32) *int32 { return &v }
+	i64 := func(v int64) *int64 { return &v }
+	tests := []struct {
+		name      string
+		maxTokens *int32
+		seed      *int64
+		wantErr   bool
+		// want holds the expected body values; a missing key must be omitted.
+		want map[string]any
+	}{
+		{name: "unset", want: map[string]any{}},
+		{name: "max output tokens", maxTokens: i32(256), want: map[string]any{"max_completion_tokens": 256.0}},
+		{name: "seed", seed: i64(42), want: map[string]any{"seed": 42.0}},
+		{name: "zero seed is sent", seed: i64(0), want: map[string]any{"seed": 0.0}},
+		{name: "both", maxTokens: i32(1), seed: i64(-7), want: map[string]any{"max_completion_tokens": 1.0, "seed": -7.0}},
+		{name: "zero max output tokens", maxTokens: i32(0), wantErr: true},
+		{name: "negative max output tokens", maxTokens: i32(-1), wantErr: true},
+	}
+	for _, tt := range tests {
+		check := func(t *testing.T, err error, body map[string]any) {
+			t.Helper()
+			if tt.wantErr {
+				if !pb.IsInvalidParameter(err) || !strings.Contains(err.Error(), "max_output_tokens") {
+					t.Fatalf("err = %v, want INVALID_PARAMETER for max_output_tokens", err)
+				}
+				if body != nil {
+					t.Fatal("invalid request reached the upstream")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]any{}
+			for _, key := range []string{"max_completion_tokens", "seed"} {
+				if v, ok := body[key]; ok {
+					got[key] = v
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("body = %v, want %v", got, tt.want)
+			}
+		}
+		t.Run(tt.name+"/unary", func(t *testing.T) {
+			upstream, body := bodyUpstream(t)
+			s := newTestService(t, &conf.Proxy{})
+			_, err := s.ChatCompletion(context.Background(), &pb.ChatCompletionRequest{
+				Url: upstream.URL, Model: "gpt-4o", Messages: userMessages("hi"), MaxOutputTokens: tt.maxTokens, Seed: tt.seed,
+			})
+			check(t, err, body())
+		})
+		t.Run(tt.name+"/stream", func(t *testing.T) {
+			upstream, body := bodyUpstream(t)
+			s := newTestService(t, &conf.Proxy{})
+			req := streamRequest(upstream.URL, "gpt-4o")
+			req.MaxOutputTokens, req.Seed = tt.maxTokens, tt.seed
+			check(t, s.StreamChatCompletion(req, newFakeStream(context.Background())), body())
+		})
+	}
+}
+
+func TestStreamErrorEventAfterChunks(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, d := range []string{"partial ", "answer"} {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%q}}]}\n\n", d)
+		}
+		fmt.Fprint(w, "data: {\"error\":{\"message\":\"model overloaded\",\"type\":\"server_error\"}}\n\n")
+	}))
+	defer upstream.Close()
+
+	s := newTestService(t, &conf.Proxy{})
+	stream := newFakeStream(context.Background())
+	err := s.StreamChatCompletion(streamRequest(upstream.URL, "gpt-4o"), stream)
+	if err == nil {
+		t.Fatal("expected the upstream error")
+	}
+
+	got := stream.responses()
+	if len(got) != 3 {
+		t.Fatalf("got %d responses, want two chunks and the error event: %v", len(got), got)
+	}
+	if stream.content() != "partial answer" {
+		t.Fatalf("content = %q", stream.content())
+	}
+	last := got[len(got)-1]
+	se := errors.FromError(err)
+	if last.GetError() == nil || last.GetError().GetReason() != se.Reason || last.GetError().GetMessage() != se.Message {
+		t.Fatalf("last response = %v, want the error %v", last, err)
+	}
+	if last.GetChunk() != "" || last.GetModel() != "gpt-4o" {
+		t.Fatalf("error event carries chunk %q, model %q", last.GetChunk(), last.GetModel())
+	}
+	if !strings.Contains(last.GetError().GetMessage(), "model overloaded") {
+		t.Fatalf("error event message %q lacks the upstream message", last.GetError().GetMessage())
+	}
+}
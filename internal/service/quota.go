@@ -0,0 +1,91 @@
+package service
+
+import (
+	"context"
+	"sync"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+)
+
+// QuotaStore records token spend per caller and month. Months are UTC and
+// formatted as 2006-01; the service picks the month from its clock.
+// Implementations must be safe for concurrent use.
+type QuotaStore interface {
+	// Used returns the tokens caller has spent in month.
+	Used(ctx context.Context, caller, month string) (int64, error)
+	// Debit adds tokens to caller's spend for month.
+	Debit(ctx context.Context, caller, month string, tokens int64) error
+}
+
+// NewQuotaStore returns the default in-memory store. Spend is lost on restart.
+func NewQuotaStore() QuotaStore {
+	return &memoryQuotaStore{
+		used: make(map[string]int64),
+	}
+}
+
+type memoryQuotaStore struct {
+	mu   sync.Mutex
+	used map[string]int64
+}
+
+func (m *memoryQuotaStore) Used(_ context.Context, caller, month string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.used[month+"/"+caller], nil
+}
+
+func (m *memoryQuotaStore) Debit(_ context.Context, caller, month string, tokens int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.used[month+"/"+caller] += tokens
+	return nil
+}
+
+// quota enforces monthly token budgets for authenticated callers.
+type quota struct {
+	store QuotaStore
+	rt    *RuntimeConfig
+	clock Clock
+}
+
+func (q *quota) month() string {
+	return q.clock.Now().UTC().Format("2006-01")
+}
+
+// limit returns caller's monthly budget, zero meaning unlimited.
+func (q *quota) limit(caller string) int64 {
+	c := q.rt.load().quota
+	if n, ok := c.GetCallerMonthlyTokens()[caller]; ok {
+		return n
+	}
+	return c.GetMonthlyTokens()
+}
+
+func (q *quota) enabled(caller string) bool {
+	return caller != "" && q.limit(caller) > 0
+}
+
+// check rejects the request when caller's spend plus the estimated prompt
+// tokens would exceed the monthly budget.
+func (q *quota) check(ctx context.Context, caller string, estimate int) error {
+	if !q.enabled(caller) {
+		return nil
+	}
+
+	used, err := q.store.Used(ctx, caller, q.month())
+	if err != nil {
+		return pb.ErrorInternalError("quota store error: %s", err.Error())
+	}
+	if used+int64(estimate) > q.limit(caller) {
+		return pb.ErrorQuotaExceeded("caller %s used %d of %d monthly tokens, request needs about %d", caller, used, q.limit(caller), estimate)
+	}
+	return nil
+}
+
+func (q *quota) debit(ctx context.Context, caller string, tokens int) error {
+	if !q.enabled(caller) || tokens <= 0 {
+		return nil
+	}
+	return q.store.Debit(ctx, caller, q.month(), int64(tokens))
+}
@@ -0,0 +1,176 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/auth"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+func quotaService(t *testing.T, monthly int64) *OpenAIService {
+	t.Helper()
+	return newTestService(t, &conf.Proxy{Quota: &conf.Proxy_Quota{
+		MonthlyTokens:       monthly,
+		CallerMonthlyTokens: map[string]int64{"unlimited": 0},
+	}})
+}
+
+func used(t *testing.T, s *OpenAIService, caller string) int64 {
+	t.Helper()
+	n, err := s.quota.store.Used(context.Background(), caller, s.quota.month())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// hiEstimate is the pre-authorization charged for streamRequest's prompt.
+func hiEstimate() int64 {
+	return int64(estimatePromptTokens([]openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}}, "gpt-4o"))
+}
+
+func TestQuotaDebitOnCompletion(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") == "text/event-stream" {
+			writeSSE(w, "gpt-4o", "hello")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"hello"}}],"usage":{"total_tokens":7}}`)
+	}))
+	defer upstream.Close()
+
+	s := quotaService(t, 1000)
+	alice := auth.NewContext(context.Background(), "alice")
+
+	if err := s.StreamChatCompletion(streamRequest(upstream.URL, "gpt-4o"), newFakeStream(alice)); err != nil {
+		t.Fatal(err)
+	}
+	if n := used(t, s, "alice"); n != 2 {
+		t.Fatalf("after the stream used = %d, want the 2 reported tokens", n)
+	}
+	if _, err := s.ChatCompletion(alice, &pb.ChatCompletionRequest{Url: upstream.URL, Model: "gpt-4o", Messages: userMessages("hi")}); err != nil {
+		t.Fatal(err)
+	}
+	if n := used(t, s, "alice"); n != 9 {
+		t.Fatalf("after the unary call used = %d, want 9", n)
+	}
+
+	for _, caller := range []string{"", "unlimited"} {
+		ctx := context.Background()
+		if caller != "" {
+			ctx = auth.NewContext(ctx, caller)
+		}
+		if err := s.StreamChatCompletion(streamRequest(upstream.URL, "gpt-4o"), newFakeStream(ctx)); err != nil {
+			t.Fatal(err)
+		}
+		if n := used(t, s, caller); n != 0 {
+			t.Fatalf("caller %q without a budget was charged %d", caller, n)
+		}
+	}
+}
+
+func TestQuotaRejectsOverBudget(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		writeSSE(w, "gpt-4o", "hello")
+	}))
+	defer upstream.Close()
+
+	s := quotaService(t, 100)
+	alice := auth.NewContext(context.Background(), "alice")
+	if err := s.quota.store.Debit(context.Background(), "alice", s.quota.month(), 100-hiEstimate()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StreamChatCompletion(streamRequest(upstream.URL, "gpt-4o"), newFakeStream(alice)); err != nil {
+		t.Fatalf("request that exactly fits the budget: %v", err)
+	}
+
+	err := s.StreamChatCompletion(streamRequest(upstream.URL, "gpt-4o"), newFakeStream(alice))
+	if !pb.IsQuotaExceeded(err) {
+		t.Fatalf("stream err = %v, want QUOTA_EXCEEDED", err)
+	}
+	_, err = s.ChatCompletion(alice, &pb.ChatCompletionRequest{Url: upstream.URL, Model: "gpt-4o", Messages: userMessages("hi")})
+	if !pb.IsQuotaExceeded(err) {
+		t.Fatalf("unary err = %v, want QUOTA_EXCEEDED", err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("upstream called %d times, want 1", n)
+	}
+
+	bob := auth.NewContext(context.Background(), "bob")
+	if err := s.StreamChatCompletion(streamRequest(upstream.URL, "gpt-4o"), newFakeStream(bob)); err != nil {
+		t.Fatalf("another caller's budget was affected: %v", err)
+	}
+}
+
+func TestQuotaDebitsStreamsEndingWithoutUsage(t *testing.T) {
+	const delta = "0123456789abcdef" // 16 bytes, 4 estimated tokens
+
+	t.Run("truncated", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%q}}]}\n\n", delta)
+		}))
+		defer upstream.Close()
+
+		s := quotaService(t, 1000)
+		alice := auth.NewContext(context.Background(), "alice")
+		if err := s.StreamChatCompletion(streamRequest(upstream.URL, "gpt-4o"), newFakeStream(alice)); err != nil {
+			t.Fatal(err)
+		}
+		if n, want := used(t, s, "alice"), hiEstimate()+4; n != want {
+			t.Fatalf("used = %d, want %d", n, want)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		release := make(chan struct{})
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%q}}]}\n\n", delta)
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-release:
+			}
+		}))
+		defer upstream.Close()
+		defer close(release)
+
+		s := quotaService(t, 1000)
+		alice := auth.NewContext(context.Background(), "alice")
+		req := streamRequest(upstream.URL, "gpt-4o")
+		req.RequestId = "req-1"
+		stream := newFakeStream(alice)
+		done := make(chan error, 1)
+		go func() { done <- s.StreamChatCompletion(req, stream) }()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for stream.content() == "" {
+			if time.Now().After(deadline) {
+				t.Fatal("stream did not start")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if _, err := s.CancelStream(alice, &pb.CancelStreamRequest{RequestId: "req-1"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; !pb.IsStreamCancelled(err) {
+			t.Fatalf("err = %v, want STREAM_CANCELLED", err)
+		}
+		if n, want := used(t, s, "alice"), hiEstimate()+4; n != want {
+			t.Fatalf("used = %d, want %d", n, want)
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"context"
+	"io"
+
+	"github.com/go-kratos/kratos/v2/errors"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// chatStream is the part of openai.ChatCompletionStream the handler reads from.
+type chatStream interface {
+	Recv() (openai.ChatCompletionStreamResponse, error)
+	Close() error
+}
+
+// racedStream replays the first response that won the race before reading on.
+type racedStream struct {
+	*openai.ChatCompletionStream
+	cancel   context.CancelFunc
+	first    *openai.ChatCompletionStreamResponse
+	firstErr error
+}
+
+func (r *racedStream) Recv() (openai.ChatCompletionStreamResponse, error) {
+	if first := r.first; first != nil {
+		r.first = nil
+		return *first, r.firstErr
+	}
+	return r.ChatCompletionStream.Recv()
+}
+
+func (r *racedStream) Close() error {
+	defer r.cancel()
+	return r.ChatCompletionStream.Close()
+}
+
+// raceStreams opens a stream for every model at once and keeps the one whose
+// first response arrives first. The others are cancelled and closed right away
+// so they stop generating. If all fail, the last error is returned.
+func (s *OpenAIService) raceStreams(ctx context.Context, client *openai.Client, request openai.ChatCompletionRequest, models []string) (string, chatStream, error) {
+	type result struct {
+		i      int
+		stream *racedStream
+		err    error
+	}
+
+	results := make(chan result, len(models))
+	cancels := make([]context.CancelFunc, len(models))
+	for i, model := range models {
+		rctx, cancel := context.WithCancel(ctx)
+		cancels[i] = cancel
+
+		request := request
+		request.Model = model
+		go func() {
+			stream, err := client.CreateChatCompletionStream(rctx, request)
+			if err != nil {
+				results <- result{i: i, err: err}
+				return
+			}
+			first, err := stream.Recv()
+			if err != nil && !errors.Is(err, io.EOF) {
+				stream.Close()
+				results <- result{i: i, err: err}
+				return
+			}
+			results <- result{i: i, stream: &racedStream{
+				ChatCompletionStream: stream,
+				cancel:               cancel,
+				first:                &first,
+				firstErr:             err,
+			}}
+		}()
+	}
+
+	var err error
+	for n := 1; n <= len(models); n++ {
+		r := <-results
+		if r.err != nil {
+			err = r.err
+			continue
+		}
+
+		for i, cancel := range cancels {
+			if i != r.i {
+				cancel()
+			}
+		}
+		// Close losers that got a stream open before they saw the cancel.
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				if lost := <-results; lost.stream != nil {
+					lost.stream.Close()
+				}
+			}
+		}(len(models) - n)
+
+		s.log.WithContext(ctx).Infof("stream race won by model %s", models[r.i])
+		return models[r.i], r.stream, nil
+	}
+
+	for _, cancel := range cancels {
+		cancel()
+	}
+	return "", nil, err
+}
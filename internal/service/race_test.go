@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+func TestRaceStreamsPicksFastestAndClosesLoser(t *testing.T) {
+	release := make(chan struct{})
+	loserClosed := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Model string `json:"model"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+			return
+		}
+		if body.Model == "slow" {
+			select {
+			case <-r.Context().Done():
+				close(loserClosed)
+			case <-release:
+			}
+			return
+		}
+		writeSSE(w, body.Model, "fast ", "answer")
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	s := newTestService(t, &conf.Proxy{})
+	req := streamRequest(upstream.URL, "slow")
+	req.FallbackModels = []string{"fast"}
+	req.Race = true
+	stream := newFakeStream(context.Background())
+
+	done := make(chan error, 1)
+	go func() { done <- s.StreamChatCompletion(req, stream) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("race waited for the slow upstream")
+	}
+
+	if got := stream.content(); got != "fast answer" {
+		t.Fatalf("content = %q, want the fast upstream's answer", got)
+	}
+	for _, r := range stream.responses() {
+		if r.GetModel() != "fast" {
+			t.Fatalf("response from model %q, want fast", r.GetModel())
+		}
+	}
+
+	select {
+	case <-loserClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow upstream's connection was not closed")
+	}
+}
+
+func TestRaceStreamsFallsBackWhenOneFails(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Model string `json:"model"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.Model == "broken" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"message":"bad model"}}`))
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+		writeSSE(w, body.Model, "ok")
+	}))
+	defer upstream.Close()
+
+	s := newTestService(t, &conf.Proxy{})
+	req := streamRequest(upstream.URL, "broken")
+	req.FallbackModels = []string{"working"}
+	req.Race = true
+	stream := newFakeStream(context.Background())
+	if err := s.StreamChatCompletion(req, stream); err != nil {
+		t.Fatal(err)
+	}
+	if got := stream.content(); got != "ok" {
+		t.Fatalf("content = %q, want ok", got)
+	}
+}
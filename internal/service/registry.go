@@ -0,0 +1,104 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+)
+
+// streamRegistry tracks in-flight streams by request ID so they can be listed
+// and cancelled from another connection.
+type streamRegistry struct {
+	mu      sync.Mutex
+	streams map[string]*streamEntry
+}
+
+type streamEntry struct {
+	cancel context.CancelCauseFunc
+	caller string
+	model  string
+	stats  *streamStats
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{
+		streams: make(map[string]*streamEntry),
+	}
+}
+
+// add registers a stream under id, or a random generated ID when id is empty,
+// so other callers cannot guess it. The returned function must be called when
+// the stream ends to remove it from the registry.
+func (r *streamRegistry) add(id string, e *streamEntry) (func(), error) {
+	if id == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, pb.ErrorInternalError("generate request_id: %s", err.Error())
+		}
+		id = "srv-" + hex.EncodeToString(b)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.streams[id]; ok {
+		return nil, pb.ErrorStreamAlreadyExists("request_id: %s", id)
+	}
+	r.streams[id] = e
+
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		// A cancelled stream may already have been replaced by a new one
+		// under the same ID.
+		if r.streams[id] == e {
+			delete(r.streams, id)
+		}
+	}, nil
+}
+
+// cancel stops the stream registered under id. Only the caller that started
+// it may cancel it, unless admin is set.
+func (r *streamRegistry) cancel(id, caller string, admin bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.streams[id]
+	if !ok {
+		return pb.ErrorStreamNotFound("request_id: %s", id)
+	}
+	if !admin && e.caller != caller {
+		return pb.ErrorForbidden("caller %s does not own stream %s", caller, id)
+	}
+	e.cancel(pb.ErrorStreamCancelled("request_id: %s", id))
+	delete(r.streams, id)
+
+	return nil
+}
+
+// list returns the in-flight streams, oldest first.
+func (r *streamRegistry) list() []*pb.StreamInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	streams := make([]*pb.StreamInfo, 0, len(r.streams))
+	for id, e := range r.streams {
+		streams = append(streams, &pb.StreamInfo{
+			RequestId: id,
+			Caller:    e.caller,
+			Model:     e.model,
+			StartTime: timestamppb.New(e.stats.start),
+			Chunks:    e.stats.chunks.Load(),
+		})
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].GetStartTime().AsTime().Before(streams[j].GetStartTime().AsTime())
+	})
+	return streams
+}
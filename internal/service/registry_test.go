@@ -0,0 +1,231 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/auth"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+func newTestEntry(caller string) (*streamEntry, context.Context) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	return &streamEntry{cancel: cancel, caller: caller, stats: &streamStats{}}, ctx
+}
+
+func TestRegistryCancel(t *testing.T) {
+	r := newStreamRegistry()
+	e, ctx := newTestEntry("alice")
+	remove, err := r.add("req-1", e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remove()
+
+	if _, err := r.add("req-1", e); !pb.IsStreamAlreadyExists(err) {
+		t.Fatalf("duplicate add err = %v, want STREAM_ALREADY_EXISTS", err)
+	}
+	if err := r.cancel("unknown", "alice", false); !pb.IsStreamNotFound(err) {
+		t.Fatalf("unknown id err = %v, want STREAM_NOT_FOUND", err)
+	}
+	if err := r.cancel("req-1", "bob", false); !pb.IsForbidden(err) {
+		t.Fatalf("other caller err = %v, want FORBIDDEN", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("stream cancelled by a caller that does not own it")
+	}
+
+	if err := r.cancel("req-1", "alice", false); err != nil {
+		t.Fatal(err)
+	}
+	if !pb.IsStreamCancelled(context.Cause(ctx)) {
+		t.Fatalf("cause = %v, want STREAM_CANCELLED", context.Cause(ctx))
+	}
+	if err := r.cancel("req-1", "alice", false); !pb.IsStreamNotFound(err) {
+		t.Fatalf("second cancel err = %v, want STREAM_NOT_FOUND", err)
+	}
+}
+
+func TestRegistryAdminCancel(t *testing.T) {
+	r := newStreamRegistry()
+	e, ctx := newTestEntry("alice")
+	remove, err := r.add("req-1", e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remove()
+
+	if err := r.cancel("req-1", "root", true); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Err() == nil {
+		t.Fatal("admin cancel did not stop the stream")
+	}
+}
+
+// A stream cancelled by ID may linger until its goroutine returns; its
+// cleanup must not remove a newer stream that reused the ID.
+func TestRegistryRemoveKeepsReplacement(t *testing.T) {
+	r := newStreamRegistry()
+	old, _ := newTestEntry("alice")
+	removeOld, err := r.add("req-1", old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.cancel("req-1", "alice", false); err != nil {
+		t.Fatal(err)
+	}
+
+	replacement, _ := newTestEntry("alice")
+	removeNew, err := r.add("req-1", replacement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removeOld()
+	if r.streams["req-1"] != replacement {
+		t.Fatal("cleanup of the cancelled stream removed its replacement")
+	}
+	removeNew()
+	if len(r.streams) != 0 {
+		t.Fatalf("%d streams left after cleanup", len(r.streams))
+	}
+}
+
+func TestRegistryGeneratedIDs(t *testing.T) {
+	r := newStreamRegistry()
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		e, _ := newTestEntry("alice")
+		if _, err := r.add("", e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, s := range r.list() {
+		id := s.GetRequestId()
+		if !strings.HasPrefix(id, "srv-") || len(id) != len("srv-")+32 {
+			t.Fatalf("generated id %q is not srv- and 128 random bits", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != 100 {
+		t.Fatalf("got %d distinct ids, want 100", len(seen))
+	}
+}
+
+func TestCancelStreamByID(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"thinking\"}}]}\n\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	s := newTestService(t, &conf.Proxy{})
+	ctx := auth.NewContext(context.Background(), "alice")
+	req := streamRequest(upstream.URL, "gpt-4o")
+	req.RequestId = "req-1"
+	stream := newFakeStream(ctx)
+	done := make(chan error, 1)
+	go func() { done <- s.StreamChatCompletion(req, stream) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for stream.content() == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("stream did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	bob := auth.NewContext(context.Background(), "bob")
+	if _, err := s.CancelStream(bob, &pb.CancelStreamRequest{RequestId: "req-1"}); !pb.IsForbidden(err) {
+		t.Fatalf("CancelStream by another caller err = %v, want FORBIDDEN", err)
+	}
+	if _, err := s.CancelStream(ctx, &pb.CancelStreamRequest{RequestId: "req-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if !pb.IsStreamCancelled(err) {
+			t.Fatalf("stream err = %v, want STREAM_CANCELLED", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not stop after CancelStream")
+	}
+	if _, err := s.CancelStream(ctx, &pb.CancelStreamRequest{RequestId: "req-1"}); !pb.IsStreamNotFound(err) {
+		t.Fatalf("CancelStream after the stream ended err = %v, want STREAM_NOT_FOUND", err)
+	}
+}
+
+func TestListStreams(t *testing.T) {
+	upstream := hangingUpstream(t, "thinking")
+	clock := newFakeClock()
+	s := newTestService(t, &conf.Proxy{Admin: &conf.Proxy_Admin{Callers: []string{"root"}}}, WithClock(clock))
+	root := auth.NewContext(context.Background(), "root")
+
+	start := func(caller, id, model string) (*fakeStream, chan error) {
+		req := streamRequest(upstream.URL, model)
+		req.RequestId = id
+		stream := newFakeStream(auth.NewContext(context.Background(), caller))
+		done := make(chan error, 1)
+		go func() { done <- s.StreamChatCompletion(req, stream) }()
+		waitForContent(t, stream, "thinking")
+		return stream, done
+	}
+	t0 := clock.Now()
+	_, aliceDone := start("alice", "req-alice", "gpt-4o")
+	clock.Advance(time.Second)
+	_, bobDone := start("bob", "req-bob", "gpt-4o-mini")
+
+	res, err := s.ListStreams(root, &pb.ListStreamsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*pb.StreamInfo{
+		{RequestId: "req-alice", Caller: "alice", Model: "gpt-4o", StartTime: timestamppb.New(t0), Chunks: 1},
+		{RequestId: "req-bob", Caller: "bob", Model: "gpt-4o-mini", StartTime: timestamppb.New(t0.Add(time.Second)), Chunks: 1},
+	}
+	if len(res.GetStreams()) != len(want) {
+		t.Fatalf("streams = %v, want %v", res.GetStreams(), want)
+	}
+	for i, got := range res.GetStreams() {
+		if !proto.Equal(got, want[i]) {
+			t.Fatalf("stream %d = %v, want %v", i, got, want[i])
+		}
+	}
+
+	for _, caller := range []string{"alice", "bob"} {
+		_, err := s.ListStreams(auth.NewContext(context.Background(), caller), &pb.ListStreamsRequest{})
+		if !pb.IsForbidden(err) {
+			t.Fatalf("ListStreams by %s err = %v, want FORBIDDEN", caller, err)
+		}
+	}
+	// Without authentication there is no caller to check.
+	if res, err := s.ListStreams(context.Background(), &pb.ListStreamsRequest{}); err != nil || len(res.GetStreams()) != 2 {
+		t.Fatalf("unauthenticated ListStreams = %v, %v", res, err)
+	}
+
+	for id, done := range map[string]chan error{"req-alice": aliceDone, "req-bob": bobDone} {
+		if _, err := s.CancelStream(root, &pb.CancelStreamRequest{RequestId: id}); err != nil {
+			t.Fatal(err)
+		}
+		<-done
+	}
+	if res, err := s.ListStreams(root, &pb.ListStreamsRequest{}); err != nil || len(res.GetStreams()) != 0 {
+		t.Fatalf("finished streams still listed: %v, %v", res, err)
+	}
+}
@@ -0,0 +1,120 @@
+package service
+
+import (
+	"sync/atomic"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+// staticKeys are proxy settings baked into long-lived objects at startup
+// (buffers, the HTTP transport, the limiter, the cache). Changing them needs a
+// restart.
+var staticKeys = map[string]bool{
+	"stream":      true,
+	"upstream":    true,
+	"concurrency": true,
+	"cache":       true,
+}
+
+// RuntimeConfig holds the proxy settings that can be changed without a
+// restart. Services load a snapshot per request, so a reload never affects a
+// request halfway through.
+type RuntimeConfig struct {
+	v atomic.Pointer[runtimeSnapshot]
+}
+
+type runtimeSnapshot struct {
+	c *conf.Proxy
+
+	systemPrompt *conf.Proxy_SystemPrompt
+	limits       limits
+	sampling     *conf.Proxy_Sampling
+	vault        vault
+	retry        *conf.Proxy_Retry
+	quota        *conf.Proxy_Quota
+	models       []*conf.Proxy_Model
+	admins       []string
+	sampleRate   uint64
+	shadows      map[string]*conf.Proxy_Shadow
+	aliases      map[string]string
+}
+
+func NewRuntimeConfig(c *conf.Proxy) *RuntimeConfig {
+	r := &RuntimeConfig{}
+	r.store(c)
+	return r
+}
+
+func (r *RuntimeConfig) load() *runtimeSnapshot {
+	return r.v.Load()
+}
+
+func (r *RuntimeConfig) store(c *conf.Proxy) {
+	// upstream is static, so vault tokens keep going to the base URL the
+	// clients were built with.
+	baseURL := c.GetUpstream().GetBaseUrl()
+	if prev := r.load(); prev != nil {
+		baseURL = prev.vault.baseURL
+	}
+	r.v.Store(&runtimeSnapshot{
+		c:            c,
+		systemPrompt: c.GetSystemPrompt(),
+		limits:       newLimits(c.GetLimits()),
+		sampling:     c.GetSampling(),
+		vault:        vault{c: c.GetVault(), baseURL: baseURL},
+		retry:        c.GetRetry(),
+		quota:        c.GetQuota(),
+		models:       c.GetModels(),
+		admins:       c.GetAdmin().GetCallers(),
+		sampleRate:   uint64(c.GetAccessLog().GetSampleRate()),
+		shadows:      shadowsByCaller(c.GetShadows()),
+		aliases:      c.GetModelAliases(),
+	})
+}
+
+// resolveModels maps the requested model and its fallbacks through the
+// configured aliases. Names without an alias pass through unchanged.
+func (r *runtimeSnapshot) resolveModels(model string, fallbacks []string) []string {
+	models := make([]string, 0, 1+len(fallbacks))
+	for _, name := range append([]string{model}, fallbacks...) {
+		if target, ok := r.aliases[name]; ok {
+			name = target
+		}
+		models = append(models, name)
+	}
+	return models
+}
+
+// Update swaps in c for subsequent requests. It reports the changed top-level
+// keys that took effect and those that still need a restart.
+func (r *RuntimeConfig) Update(c *conf.Proxy) (applied, ignored []string) {
+	prev := r.load().c.ProtoReflect()
+	next := c.ProtoReflect()
+
+	fields := next.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+
+		a, b := &conf.Proxy{}, &conf.Proxy{}
+		if prev.Has(fd) {
+			a.ProtoReflect().Set(fd, prev.Get(fd))
+		}
+		if next.Has(fd) {
+			b.ProtoReflect().Set(fd, next.Get(fd))
+		}
+		if proto.Equal(a, b) {
+			continue
+		}
+
+		if staticKeys[string(fd.Name())] {
+			ignored = append(ignored, string(fd.Name()))
+		} else {
+			applied = append(applied, string(fd.Name()))
+		}
+	}
+
+	r.store(c)
+	return applied, ignored
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+func TestResolveModels(t *testing.T) {
+	rt := NewRuntimeConfig(&conf.Proxy{ModelAliases: map[string]string{"fast": "gpt-4o-mini"}}).load()
+	tests := []struct {
+		name      string
+		model     string
+		fallbacks []string
+		want      []string
+	}{
+		{name: "alias", model: "fast", want: []string{"gpt-4o-mini"}},
+		{name: "no alias", model: "gpt-4o", want: []string{"gpt-4o"}},
+		{name: "aliased fallback", model: "gpt-4o", fallbacks: []string{"fast", "o3-mini"}, want: []string{"gpt-4o", "gpt-4o-mini", "o3-mini"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rt.resolveModels(tt.model, tt.fallbacks); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Without aliases every name passes through.
+	if got := NewRuntimeConfig(&conf.Proxy{}).load().resolveModels("fast", nil); !reflect.DeepEqual(got, []string{"fast"}) {
+		t.Fatalf("got %v without aliases", got)
+	}
+}
+
+func TestModelAliasReachesUpstream(t *testing.T) {
+	upstream, body := bodyUpstream(t)
+	s := newTestService(t, &conf.Proxy{ModelAliases: map[string]string{"fast": "gpt-4o-mini"}})
+
+	for model, want := range map[string]string{"fast": "gpt-4o-mini", "gpt-4o": "gpt-4o"} {
+		if err := s.StreamChatCompletion(streamRequest(upstream.URL, model), newFakeStream(context.Background())); err != nil {
+			t.Fatal(err)
+		}
+		if got := body()["model"]; got != want {
+			t.Fatalf("requested %s, upstream got model %v, want %s", model, got, want)
+		}
+	}
+}
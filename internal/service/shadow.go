@@ -0,0 +1,87 @@
+package service
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+
+	"github.com/go-kratos/kratos/v2/errors"
+	"github.com/go-kratos/kratos/v2/log"
+	openai "github.com/sashabaranov/go-openai"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+func shadowsByCaller(shadows []*conf.Proxy_Shadow) map[string]*conf.Proxy_Shadow {
+	m := make(map[string]*conf.Proxy_Shadow, len(shadows))
+	for _, sh := range shadows {
+		m[sh.GetCaller()] = sh
+	}
+	return m
+}
+
+// startShadow mirrors a sampled share of caller's streams to the configured
+// shadow model. The shadow runs under ctx, so it ends with the primary stream;
+// its output is discarded and its failures never reach the caller. Usage is
+// not debited from the caller's quota.
+func (s *OpenAIService) startShadow(ctx context.Context, client *openai.Client, request openai.ChatCompletionRequest, caller string) {
+	sh, ok := s.rt.load().shadows[caller]
+	if !ok || sh.GetModel() == "" || rand.Float64()*100 >= sh.GetPercent() {
+		return
+	}
+
+	primary := request.Model
+	request.Model = sh.GetModel()
+	// Keep the shadow's responses out of the primary's error metadata.
+	ctx, _ = withUpstreamResponse(ctx)
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				_ = s.recovered(ctx, r)
+			}
+		}()
+
+		var (
+			start      = s.clock.Now()
+			firstChunk float64
+			usage      *pb.Usage
+			errMsg     string
+		)
+		err := func() error {
+			stream, err := client.CreateChatCompletionStream(ctx, request)
+			if err != nil {
+				return err
+			}
+			defer stream.Close()
+
+			for {
+				response, err := stream.Recv()
+				if err != nil {
+					return err
+				}
+				if response.Usage != nil {
+					usage = convertUsage(response.Usage)
+				}
+				if firstChunk == 0 && len(response.Choices) > 0 {
+					firstChunk = s.clock.Now().Sub(start).Seconds()
+				}
+			}
+		}()
+		if err != nil && !errors.Is(err, io.EOF) {
+			errMsg = err.Error()
+		}
+
+		s.log.WithContext(ctx).Log(log.LevelInfo,
+			"msg", "shadow stream",
+			"primary_model", primary,
+			"model", request.Model,
+			"first_chunk", firstChunk,
+			"duration", s.clock.Now().Sub(start).Seconds(),
+			"prompt_tokens", usage.GetPromptTokens(),
+			"completion_tokens", usage.GetCompletionTokens(),
+			"error", errMsg,
+		)
+	}()
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wolodata/proxy-service/internal/auth"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+// shadowLine waits for the shadow stream line logged once the shadow ends.
+func shadowLine(t *testing.T, logs *captureLogger) map[string]any {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if lines := logs.captured(); len(lines) > 0 {
+			return lines[0]
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("shadow stream was never logged")
+	return nil
+}
+
+// shadowUpstream opens the primary stream but holds its deltas until release
+// is closed, fails
+// shadow-failing and holds shadow-hanging open until the client goes away.
+func shadowUpstream(t *testing.T, release <-chan struct{}) (upstream *httptest.Server, shadowArrived, shadowCancelled <-chan struct{}) {
+	arrived, cancelled := make(chan struct{}), make(chan struct{})
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Model string }
+		json.NewDecoder(r.Body).Decode(&body)
+		io.Copy(io.Discard, r.Body)
+		switch body.Model {
+		case "shadow-failing":
+			close(arrived)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":{"message":"shadow is down"}}`))
+		case "shadow-hanging":
+			close(arrived)
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			close(cancelled)
+		default:
+			// The shadow starts once the primary stream is open.
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.(http.Flusher).Flush()
+			<-release
+			writeSSE(w, body.Model, "hello")
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, arrived, cancelled
+}
+
+func TestStartShadowIsolation(t *testing.T) {
+	tests := []struct {
+		name   string
+		shadow string
+		// primaryWaitsForLog holds the primary open until the shadow has
+		// finished, so the shadow fails on its own instead of being cancelled.
+		primaryWaitsForLog bool
+		wantError          string
+		wantCancelled      bool
+	}{
+		{name: "shadow failure stays out of the primary", shadow: "shadow-failing", primaryWaitsForLog: true, wantError: "shadow is down"},
+		{name: "shadow ends with the primary", shadow: "shadow-hanging", wantError: "context canceled", wantCancelled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			releaseCh := make(chan struct{})
+			upstream, shadowArrived, shadowCancelled := shadowUpstream(t, releaseCh)
+			release := sync.OnceFunc(func() { close(releaseCh) })
+			t.Cleanup(release)
+
+			c := &conf.Proxy{Shadows: []*conf.Proxy_Shadow{{Caller: "alice", Model: tt.shadow, Percent: 100}}}
+			httpClient, err := NewHTTPClient(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			logs := &captureLogger{msg: "shadow stream"}
+			s := NewOpenAIService(c, NewRuntimeConfig(c), httpClient, nil, NewQuotaStore(), logs)
+
+			primary := newFakeStream(auth.NewContext(context.Background(), "alice"))
+			done := make(chan error, 1)
+			go func() { done <- s.StreamChatCompletion(streamRequest(upstream.URL, "gpt-4o"), primary) }()
+
+			select {
+			case <-shadowArrived:
+			case <-time.After(2 * time.Second):
+				t.Fatal("shadow never reached the upstream")
+			}
+			var line map[string]any
+			if tt.primaryWaitsForLog {
+				line = shadowLine(t, logs)
+			}
+			release()
+			if err := <-done; err != nil {
+				t.Fatalf("primary failed: %v", err)
+			}
+			if got := primary.content(); got != "hello" {
+				t.Fatalf("primary content = %q, want hello", got)
+			}
+			if primary.lastError() != nil {
+				t.Fatalf("primary got error event %v", primary.lastError())
+			}
+
+			if tt.wantCancelled {
+				select {
+				case <-shadowCancelled:
+				case <-time.After(2 * time.Second):
+					t.Fatal("shadow request outlived the primary stream")
+				}
+			}
+			if line == nil {
+				line = shadowLine(t, logs)
+			}
+			if line["model"] != tt.shadow || line["primary_model"] != "gpt-4o" {
+				t.Fatalf("shadow line = %v", line)
+			}
+			if msg, _ := line["error"].(string); !strings.Contains(msg, tt.wantError) {
+				t.Fatalf("shadow error = %q, want it to contain %q", msg, tt.wantError)
+			}
+		})
+	}
+}
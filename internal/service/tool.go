@@ -0,0 +1,133 @@
+package service
+
+import (
+	"encoding/json"
+	"regexp"
+
+	openai "github.com/sashabaranov/go-openai"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+)
+
+// toolName is the function name pattern upstreams accept.
+var toolName = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// noParameters is sent for tools without a schema, since upstreams reject a
+// null one.
+var noParameters = json.RawMessage(`{"type":"object","properties":{}}`)
+
+// convertTools validates the function tools and tool choice of a request and
+// converts them to their OpenAI form. A tool choice naming a function forces
+// that tool.
+func convertTools(tools []*pb.Tool, choice string) ([]openai.Tool, any, error) {
+	res := make([]openai.Tool, 0, len(tools))
+	names := make(map[string]bool, len(tools))
+
+	for i, v := range tools {
+		if !toolName.MatchString(v.GetName()) {
+			return nil, nil, pb.ErrorInvalidParameter("tool %d: invalid name %q", i, v.GetName())
+		}
+		if names[v.GetName()] {
+			return nil, nil, pb.ErrorInvalidParameter("tool %d: duplicate name %s", i, v.GetName())
+		}
+		names[v.GetName()] = true
+
+		fn := &openai.FunctionDefinition{
+			Name:        v.GetName(),
+			Description: v.GetDescription(),
+			Parameters:  noParameters,
+		}
+		if v.GetParameters() != "" {
+			if !json.Valid([]byte(v.GetParameters())) {
+				return nil, nil, pb.ErrorInvalidParameter("tool %s: parameters is not valid JSON", v.GetName())
+			}
+			fn.Parameters = json.RawMessage(v.GetParameters())
+		}
+		res = append(res, openai.Tool{Type: openai.ToolTypeFunction, Function: fn})
+	}
+
+	switch {
+	case choice == "":
+		return res, nil, nil
+	case len(tools) == 0:
+		return nil, nil, pb.ErrorInvalidParameter("tool_choice is set without tools")
+	case choice == "auto" || choice == "none" || choice == "required":
+		return res, choice, nil
+	case names[choice]:
+		return res, openai.ToolChoice{
+			Type:     openai.ToolTypeFunction,
+			Function: openai.ToolFunction{Name: choice},
+		}, nil
+	default:
+		return nil, nil, pb.ErrorInvalidParameter("tool_choice: unknown tool %s", choice)
+	}
+}
+
+// convertToolCalls maps the tool calls of a follow-up assistant message to
+// their OpenAI form.
+func convertToolCalls(calls []*pb.ToolCall) []openai.ToolCall {
+	if len(calls) == 0 {
+		return nil
+	}
+	res := make([]openai.ToolCall, 0, len(calls))
+	for _, v := range calls {
+		res = append(res, openai.ToolCall{
+			ID:   v.GetId(),
+			Type: openai.ToolTypeFunction,
+			Function: openai.FunctionCall{
+				Name:      v.GetName(),
+				Arguments: v.GetArguments(),
+			},
+		})
+	}
+	return res
+}
+
+// toolCallsToProto maps upstream tool calls to the proto message.
+func toolCallsToProto(calls []openai.ToolCall) []*pb.ToolCall {
+	if len(calls) == 0 {
+		return nil
+	}
+	res := make([]*pb.ToolCall, 0, len(calls))
+	for _, v := range calls {
+		res = append(res, &pb.ToolCall{
+			Id:        v.ID,
+			Name:      v.Function.Name,
+			Arguments: v.Function.Arguments,
+		})
+	}
+	return res
+}
+
+// toolCallAccumulator joins streamed tool call deltas into complete calls.
+// Deltas carry the id and name once and the arguments in fragments, keyed by
+// the index of the call.
+type toolCallAccumulator struct {
+	calls []openai.ToolCall
+}
+
+func (a *toolCallAccumulator) add(deltas []openai.ToolCall) {
+	for i, d := range deltas {
+		index := i
+		if d.Index != nil {
+			index = *d.Index
+		}
+		// Indexes are sequential; anything else starts a new call rather
+		// than growing the slice to an upstream supplied size.
+		if index < 0 || index > len(a.calls) {
+			index = len(a.calls)
+		}
+		if index == len(a.calls) {
+			a.calls = append(a.calls, openai.ToolCall{Type: openai.ToolTypeFunction})
+		}
+
+		call := &a.calls[index]
+		if d.ID != "" {
+			call.ID = d.ID
+		}
+		if d.Function.Name != "" {
+			call.Function.Name = d.Function.Name
+		}
+		call.Function.Arguments += d.Function.Arguments
+	}
+}
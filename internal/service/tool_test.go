@@ -0,0 +1,242 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+func TestToolCallAccumulator(t *testing.T) {
+	index := func(i int) *int { return &i }
+	delta := func(i *int, id, name, args string) openai.ToolCall {
+		return openai.ToolCall{Index: i, ID: id, Function: openai.FunctionCall{Name: name, Arguments: args}}
+	}
+	call := func(id, name, args string) openai.ToolCall {
+		return openai.ToolCall{ID: id, Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: name, Arguments: args}}
+	}
+	tests := []struct {
+		name   string
+		deltas [][]openai.ToolCall
+		want   []openai.ToolCall
+	}{
+		{
+			name: "one call in fragments",
+			deltas: [][]openai.ToolCall{
+				{delta(index(0), "call_1", "get_weather", "")},
+				{delta(index(0), "", "", `{"city":`)},
+				{delta(index(0), "", "", `"Paris"}`)},
+			},
+			want: []openai.ToolCall{call("call_1", "get_weather", `{"city":"Paris"}`)},
+		},
+		{
+			name: "parallel calls interleaved",
+			deltas: [][]openai.ToolCall{
+				{delta(index(0), "call_1", "get_weather", `{"city":`)},
+				{delta(index(1), "call_2", "get_time", `{"tz":`)},
+				{delta(index(0), "", "", `"Paris"}`)},
+				{delta(index(1), "", "", `"CET"}`)},
+			},
+			want: []openai.ToolCall{
+				call("call_1", "get_weather", `{"city":"Paris"}`),
+				call("call_2", "get_time", `{"tz":"CET"}`),
+			},
+		},
+		{
+			name: "missing index uses the position in the delta",
+			deltas: [][]openai.ToolCall{
+				{delta(nil, "call_1", "a", "{}"), delta(nil, "call_2", "b", "{}")},
+			},
+			want: []openai.ToolCall{call("call_1", "a", "{}"), call("call_2", "b", "{}")},
+		},
+		{
+			name: "out of range index starts a new call",
+			deltas: [][]openai.ToolCall{
+				{delta(index(0), "call_1", "a", "{}")},
+				{delta(index(1000), "call_2", "b", "{}")},
+				{delta(index(-1), "call_3", "c", "{}")},
+			},
+			want: []openai.ToolCall{call("call_1", "a", "{}"), call("call_2", "b", "{}"), call("call_3", "c", "{}")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var a toolCallAccumulator
+			for _, d := range tt.deltas {
+				a.add(d)
+			}
+			if !reflect.DeepEqual(a.calls, tt.want) {
+				t.Fatalf("calls = %+v, want %+v", a.calls, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertTools(t *testing.T) {
+	weather := &pb.Tool{Name: "get_weather", Description: "Current weather", Parameters: `{"type":"object","properties":{"city":{"type":"string"}}}`}
+	tests := []struct {
+		name       string
+		tools      []*pb.Tool
+		choice     string
+		wantChoice any
+		wantErr    string
+	}{
+		{name: "no tools"},
+		{name: "tools without choice", tools: []*pb.Tool{weather, {Name: "get_time"}}},
+		{name: "auto", tools: []*pb.Tool{weather}, choice: "auto", wantChoice: "auto"},
+		{name: "none", tools: []*pb.Tool{weather}, choice: "none", wantChoice: "none"},
+		{name: "required", tools: []*pb.Tool{weather}, choice: "required", wantChoice: "required"},
+		{
+			name: "named tool", tools: []*pb.Tool{weather}, choice: "get_weather",
+			wantChoice: openai.ToolChoice{Type: openai.ToolTypeFunction, Function: openai.ToolFunction{Name: "get_weather"}},
+		},
+		{name: "empty name", tools: []*pb.Tool{{}}, wantErr: "invalid name"},
+		{name: "invalid name", tools: []*pb.Tool{{Name: "get weather"}}, wantErr: "invalid name"},
+		{name: "name too long", tools: []*pb.Tool{{Name: strings.Repeat("a", 65)}}, wantErr: "invalid name"},
+		{name: "duplicate name", tools: []*pb.Tool{weather, {Name: "get_weather"}}, wantErr: "duplicate name"},
+		{name: "invalid parameters", tools: []*pb.Tool{{Name: "f", Parameters: "{"}}, wantErr: "not valid JSON"},
+		{name: "choice without tools", choice: "auto", wantErr: "without tools"},
+		{name: "unknown choice", tools: []*pb.Tool{weather}, choice: "get_time", wantErr: "unknown tool"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tools, choice, err := convertTools(tt.tools, tt.choice)
+			if tt.wantErr != "" {
+				if !pb.IsInvalidParameter(err) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want INVALID_PARAMETER with %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(choice, tt.wantChoice) {
+				t.Fatalf("choice = %#v, want %#v", choice, tt.wantChoice)
+			}
+			if len(tools) != len(tt.tools) {
+				t.Fatalf("got %d tools, want %d", len(tools), len(tt.tools))
+			}
+			for i, v := range tools {
+				want := tt.tools[i].GetParameters()
+				if want == "" {
+					want = string(noParameters)
+				}
+				if v.Type != openai.ToolTypeFunction || v.Function.Name != tt.tools[i].GetName() || string(v.Function.Parameters.(json.RawMessage)) != want {
+					t.Fatalf("tool %d = %+v", i, v.Function)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamToolCalls(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, d := range []string{
+			`{"index":0,"id":"call_1","type":"function","function":{"name":"get_weather","arguments":""}}`,
+			`{"index":1,"id":"call_2","type":"function","function":{"name":"get_time","arguments":"{}"}}`,
+			`{"index":0,"function":{"arguments":"{\"city\":"}}`,
+			`{"index":0,"function":{"arguments":"\"Paris\"}"}}`,
+		} {
+			fmt.Fprintf(w, "data: {\"model\":\"gpt-4o\",\"choices\":[{\"delta\":{\"tool_calls\":[%s]}}]}\n\n", d)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	s := newTestService(t, &conf.Proxy{})
+	req := streamRequest(upstream.URL, "gpt-4o")
+	req.Tools = []*pb.Tool{{Name: "get_weather"}, {Name: "get_time"}}
+	stream := newFakeStream(context.Background())
+	if err := s.StreamChatCompletion(req, stream); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := stream.content(); got != "" {
+		t.Fatalf("tool call deltas streamed as content %q", got)
+	}
+	var calls []*pb.ToolCall
+	for _, r := range stream.responses() {
+		calls = append(calls, r.GetToolCalls()...)
+	}
+	want := []*pb.ToolCall{
+		{Id: "call_1", Name: "get_weather", Arguments: `{"city":"Paris"}`},
+		{Id: "call_2", Name: "get_time", Arguments: "{}"},
+	}
+	if len(calls) != len(want) {
+		t.Fatalf("tool calls = %v, want %v", calls, want)
+	}
+	for i := range want {
+		if !proto.Equal(calls[i], want[i]) {
+			t.Fatalf("tool call %d = %v, want %v", i, calls[i], want[i])
+		}
+	}
+}
+
+func TestToolResultFollowUp(t *testing.T) {
+	upstream, body := bodyUpstream(t)
+	s := newTestService(t, &conf.Proxy{})
+
+	messages := []*pb.ChatCompletionMessage{
+		{Role: pb.ChatCompletionMessageRole_CHAT_COMPLETION_MESSAGE_ROLE_USER, Content: "Weather in Paris?"},
+		{
+			Role:      pb.ChatCompletionMessageRole_CHAT_COMPLETION_MESSAGE_ROLE_ASSISTANT,
+			ToolCalls: []*pb.ToolCall{{Id: "call_1", Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+		},
+		{Role: pb.ChatCompletionMessageRole_CHAT_COMPLETION_MESSAGE_ROLE_TOOL, ToolCallId: "call_1", Content: `{"temp":18}`},
+	}
+	_, err := s.ChatCompletion(context.Background(), &pb.ChatCompletionRequest{
+		Url: upstream.URL, Model: "gpt-4o", Messages: messages, Tools: []*pb.Tool{{Name: "get_weather"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := json.Marshal(body()["messages"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []openai.ChatCompletionMessage
+	if err := json.Unmarshal(raw, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("messages = %s", raw)
+	}
+	if calls := got[1].ToolCalls; got[1].Role != openai.ChatMessageRoleAssistant || len(calls) != 1 ||
+		calls[0].ID != "call_1" || calls[0].Type != openai.ToolTypeFunction ||
+		calls[0].Function.Name != "get_weather" || calls[0].Function.Arguments != `{"city":"Paris"}` {
+		t.Fatalf("assistant turn = %s", raw)
+	}
+	if got[2].Role != openai.ChatMessageRoleTool || got[2].ToolCallID != "call_1" || got[2].Content != `{"temp":18}` {
+		t.Fatalf("tool result = %s", raw)
+	}
+
+	t.Run("tool message without tool_call_id", func(t *testing.T) {
+		bad := []*pb.ChatCompletionMessage{messages[0], messages[1], {Role: pb.ChatCompletionMessageRole_CHAT_COMPLETION_MESSAGE_ROLE_TOOL, Content: "{}"}}
+		_, err := s.ChatCompletion(context.Background(), &pb.ChatCompletionRequest{Url: upstream.URL, Model: "gpt-4o", Messages: bad})
+		if !pb.IsInvalidParameter(err) || !strings.Contains(err.Error(), "tool_call_id") {
+			t.Fatalf("err = %v, want INVALID_PARAMETER for tool_call_id", err)
+		}
+	})
+	t.Run("tool calls on a user message", func(t *testing.T) {
+		bad := []*pb.ChatCompletionMessage{{
+			Role: pb.ChatCompletionMessageRole_CHAT_COMPLETION_MESSAGE_ROLE_USER, Content: "hi",
+			ToolCalls: []*pb.ToolCall{{Id: "call_1", Name: "get_weather"}},
+		}}
+		_, err := s.ChatCompletion(context.Background(), &pb.ChatCompletionRequest{Url: upstream.URL, Model: "gpt-4o", Messages: bad})
+		if !pb.IsInvalidParameter(err) || !strings.Contains(err.Error(), "only assistant messages") {
+			t.Fatalf("err = %v, want INVALID_PARAMETER for tool_calls", err)
+		}
+	})
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-kratos/kratos/v2/errors"
+	openai "github.com/sashabaranov/go-openai"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+)
+
+// maxErrorBodyBytes caps the raw upstream body attached to error metadata.
+const maxErrorBodyBytes = 1024
+
+// upstreamResponse records the status and headers of the latest upstream
+// response made under a context, which go-openai errors do not carry.
+type upstreamResponse struct {
+	mu     sync.Mutex
+	status int
+	header http.Header
+}
+
+type upstreamResponseKey struct{}
+
+func withUpstreamResponse(ctx context.Context) (context.Context, *upstreamResponse) {
+	up := &upstreamResponse{}
+	return context.WithValue(ctx, upstreamResponseKey{}, up), up
+}
+
+// statusCode returns the latest upstream HTTP status, or 0 when no response
+// arrived.
+func (up *upstreamResponse) statusCode() int {
+	if up == nil {
+		return 0
+	}
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return up.status
+}
+
+// recordingTransport fills in the upstreamResponse of the request context.
+type recordingTransport struct {
+	base http.RoundTripper
+}
+
+func (t recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if up, ok := req.Context().Value(upstreamResponseKey{}).(*upstreamResponse); ok && resp != nil {
+		up.mu.Lock()
+		up.status = resp.StatusCode
+		up.header = resp.Header
+		up.mu.Unlock()
+	}
+	return resp, err
+}
+
+// limitTransport caps how many body bytes a single upstream response may
+// deliver, so a broken upstream cannot stream unbounded data through us.
+type limitTransport struct {
+	base     http.RoundTripper
+	maxBytes int64
+}
+
+func (t limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, max: t.maxBytes}
+	return resp, nil
+}
+
+// limitedBody fails reads once more than max bytes have been read.
+type limitedBody struct {
+	io.ReadCloser
+	max  int64
+	read int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.read > b.max {
+		return 0, fmt.Errorf("upstream response exceeds %d bytes", b.max)
+	}
+	// Read at most one byte past the cap to tell an exact fit from an overrun.
+	if left := b.max - b.read + 1; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.read > b.max {
+		return n - 1, err
+	}
+	return n, err
+}
+
+// upstreamError wraps an upstream failure as OPENAI_ERROR with metadata clients
+// can branch on: provider, upstream status, request id, retry-after and a
+// size-capped raw body when known.
+func upstreamError(err error, up *upstreamResponse, format string) *errors.Error {
+	md := map[string]string{
+		"provider": "openai",
+	}
+
+	status := 0
+	if up != nil {
+		up.mu.Lock()
+		status = up.status
+		if id := up.header.Get("X-Request-Id"); id != "" {
+			md["upstream_request_id"] = id
+		}
+		if ra := up.header.Get("Retry-After"); ra != "" {
+			md["retry_after"] = ra
+		}
+		up.mu.Unlock()
+	}
+
+	msg := err.Error()
+	var apiErr *openai.APIError
+	var reqErr *openai.RequestError
+	switch {
+	case errors.As(err, &apiErr):
+		status = apiErr.HTTPStatusCode
+		if apiErr.Type != "" {
+			md["upstream_type"] = apiErr.Type
+		}
+	case errors.As(err, &reqErr):
+		status = reqErr.HTTPStatusCode
+		if body := reqErr.Body; len(body) > 0 {
+			if len(body) > maxErrorBodyBytes {
+				body = body[:maxErrorBodyBytes]
+			}
+			md["upstream_body"] = strings.ToValidUTF8(string(body), "")
+		}
+		// RequestError.Error embeds the whole body; it is only carried, capped,
+		// in the metadata.
+		msg = fmt.Sprintf("error, status code: %d, status: %s, message: %v", reqErr.HTTPStatusCode, reqErr.HTTPStatus, reqErr.Err)
+	}
+	if status > 0 {
+		md["upstream_status"] = strconv.Itoa(status)
+	}
+
+	return pb.ErrorOpenaiError(format, msg).WithMetadata(md)
+}
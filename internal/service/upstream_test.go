@@ -0,0 +1,188 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	kerrors "github.com/go-kratos/kratos/v2/errors"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+func TestUpstreamErrorMetadata(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		header map[string]string
+		body   string
+		want   map[string]string
+	}{
+		{
+			name:   "rate limited",
+			status: http.StatusTooManyRequests,
+			header: map[string]string{"X-Request-Id": "req_abc123", "Retry-After": "20"},
+			body:   `{"error":{"message":"slow down","type":"rate_limit_exceeded"}}`,
+			want: map[string]string{
+				"provider":            "openai",
+				"upstream_status":     "429",
+				"upstream_request_id": "req_abc123",
+				"retry_after":         "20",
+				"upstream_type":       "rate_limit_exceeded",
+			},
+		},
+		{
+			name:   "non-JSON body",
+			status: http.StatusBadGateway,
+			body:   "<html>bad gateway</html>",
+			want: map[string]string{
+				"provider":        "openai",
+				"upstream_status": "502",
+				"upstream_body":   "<html>bad gateway</html>",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tt.header {
+					w.Header().Set(k, v)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer upstream.Close()
+
+			s := newTestService(t, &conf.Proxy{})
+			_, err := s.ChatCompletion(context.Background(), &pb.ChatCompletionRequest{Url: upstream.URL, Model: "gpt-4o", Messages: userMessages("hi")})
+			if !pb.IsOpenaiError(err) {
+				t.Fatalf("err = %v, want OPENAI_ERROR", err)
+			}
+			if md := kerrors.FromError(err).Metadata; !reflect.DeepEqual(md, tt.want) {
+				t.Fatalf("metadata = %v, want %v", md, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamErrorBodyCap(t *testing.T) {
+	body := strings.Repeat("x", 4*maxErrorBodyBytes)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(body))
+	}))
+	defer upstream.Close()
+
+	s := newTestService(t, &conf.Proxy{})
+	_, err := s.ChatCompletion(context.Background(), &pb.ChatCompletionRequest{Url: upstream.URL, Model: "gpt-4o", Messages: userMessages("hi")})
+	se := kerrors.FromError(err)
+	if got := se.Metadata["upstream_body"]; got != body[:maxErrorBodyBytes] {
+		t.Fatalf("upstream_body has %d bytes, want the first %d", len(got), maxErrorBodyBytes)
+	}
+	if strings.Contains(se.Message, body[:maxErrorBodyBytes+1]) || len(se.Message) > maxErrorBodyBytes {
+		t.Fatalf("message carries the uncapped body: %d bytes", len(se.Message))
+	}
+	if !strings.Contains(se.Message, "status code: 500") {
+		t.Fatalf("message = %q", se.Message)
+	}
+}
+
+func TestUpstreamErrorWithoutResponse(t *testing.T) {
+	err := upstreamError(errors.New("dial tcp: connection refused"), nil, "CreateChatCompletion error: %s")
+	if want := map[string]string{"provider": "openai"}; !reflect.DeepEqual(err.Metadata, want) {
+		t.Fatalf("metadata = %v, want %v", err.Metadata, want)
+	}
+	if err.Message != "CreateChatCompletion error: dial tcp: connection refused" {
+		t.Fatalf("message = %q", err.Message)
+	}
+}
+
+func TestLimitedBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		max     int64
+		wantErr bool
+	}{
+		{name: "under the cap", size: 10, max: 16},
+		{name: "exact fit", size: 16, max: 16},
+		{name: "one byte over", size: 17, max: 16, wantErr: true},
+		{name: "far over", size: 4096, max: 16, wantErr: true},
+	}
+	for _, tt := range tests {
+		for _, oneByte := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/one byte reads %v", tt.name, oneByte), func(t *testing.T) {
+				var r io.Reader = strings.NewReader(strings.Repeat("x", tt.size))
+				if oneByte {
+					r = iotest.OneByteReader(r)
+				}
+				got, err := io.ReadAll(&limitedBody{ReadCloser: io.NopCloser(r), max: tt.max})
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+				}
+				if int64(len(got)) > tt.max {
+					t.Fatalf("read %d bytes past the %d byte cap", len(got), tt.max)
+				}
+				if !tt.wantErr && len(got) != tt.size {
+					t.Fatalf("read %d of %d bytes", len(got), tt.size)
+				}
+			})
+		}
+	}
+}
+
+func TestMaxResponseBytesExactFit(t *testing.T) {
+	const body = `{"model":"gpt-4o","choices":[{"message":{"role":"assistant","content":"hello"}}]}`
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	defer upstream.Close()
+
+	req := &pb.ChatCompletionRequest{Url: upstream.URL, Model: "gpt-4o", Messages: userMessages("hi")}
+	s := newTestService(t, &conf.Proxy{Upstream: &conf.Proxy_Upstream{MaxResponseBytes: int64(len(body))}})
+	res, err := s.ChatCompletion(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.GetContent() != "hello" {
+		t.Fatalf("content = %q", res.GetContent())
+	}
+
+	s = newTestService(t, &conf.Proxy{Upstream: &conf.Proxy_Upstream{MaxResponseBytes: int64(len(body)) - 1}})
+	if _, err := s.ChatCompletion(context.Background(), req); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Fatalf("err = %v, want the response cap", err)
+	}
+}
+
+func TestStreamExceedsMaxResponseBytes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deltas := make([]string, 100)
+		for i := range deltas {
+			deltas[i] = strings.Repeat("x", 100)
+		}
+		writeSSE(w, "gpt-4o", deltas...)
+	}))
+	defer upstream.Close()
+
+	s := newTestService(t, &conf.Proxy{Upstream: &conf.Proxy_Upstream{MaxResponseBytes: 1024}})
+	stream := newFakeStream(context.Background())
+	err := s.StreamChatCompletion(streamRequest(upstream.URL, "gpt-4o"), stream)
+	if err == nil || !strings.Contains(err.Error(), "exceeds 1024 bytes") {
+		t.Fatalf("err = %v, want the response cap", err)
+	}
+	if n := len(stream.content()); n == 0 || n > 1024 {
+		t.Fatalf("streamed %d bytes before the cap, want some below 1024", n)
+	}
+	if stream.lastError() == nil {
+		t.Fatal("stream did not end with an error event")
+	}
+}
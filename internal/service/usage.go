@@ -0,0 +1,81 @@
+package service
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	openai "github.com/sashabaranov/go-openai"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+)
+
+// convertUsage maps OpenAI token usage to the proto Usage message.
+func convertUsage(u *openai.Usage) *pb.Usage {
+	if u == nil {
+		return nil
+	}
+
+	usage := &pb.Usage{
+		PromptTokens:     int64(u.PromptTokens),
+		CompletionTokens: int64(u.CompletionTokens),
+		TotalTokens:      int64(u.TotalTokens),
+	}
+	if d := u.CompletionTokensDetails; d != nil {
+		usage.ReasoningTokens = int64(d.ReasoningTokens)
+	}
+	if d := u.PromptTokensDetails; d != nil {
+		usage.CachedPromptTokens = int64(d.CachedTokens)
+	}
+	return usage
+}
+
+// estimateCompletionTokens approximates the tokens behind n bytes of streamed
+// output at four bytes per token, for charging streams that end before the
+// upstream reports usage.
+func estimateCompletionTokens(n int64) int {
+	return int((n + 3) / 4)
+}
+
+// imageTokens is what a high detail 1024x1024 image costs upstream.
+const imageTokens = 765
+
+// estimatePromptTokens approximates the prompt tokens messages will cost on
+// model, for pre-authorizing requests before the upstream reports real usage.
+// It is deterministic but not exact: ASCII text is counted at four characters
+// per token, other characters at one token each (three quarters for models on
+// the o200k tokenizer, which encodes CJK more densely), plus the chat format
+// overhead of four tokens per message and three to prime the reply. Images are
+// counted at the cost of a high detail 1024x1024 image, whatever their size.
+func estimatePromptTokens(messages []openai.ChatCompletionMessage, model string) int {
+	dense := strings.HasPrefix(model, "gpt-4o") || strings.HasPrefix(model, "o1") ||
+		strings.HasPrefix(model, "o3") || strings.HasPrefix(model, "o4")
+
+	tokens := 3
+	for _, m := range messages {
+		var ascii, other int
+		count := func(s string) {
+			for _, r := range s {
+				if r < utf8.RuneSelf {
+					ascii++
+				} else {
+					other++
+				}
+			}
+		}
+		count(m.Content)
+		for _, call := range m.ToolCalls {
+			count(call.Function.Arguments)
+		}
+		for _, part := range m.MultiContent {
+			if part.Type == openai.ChatMessagePartTypeImageURL {
+				tokens += imageTokens
+			}
+			count(part.Text)
+		}
+		if dense {
+			other = (other*3 + 3) / 4
+		}
+		tokens += 4 + (ascii+3)/4 + other
+	}
+	return tokens
+}
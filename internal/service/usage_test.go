@@ -0,0 +1,119 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+)
+
+func TestConvertUsage(t *testing.T) {
+	tests := []struct {
+		name string
+		in   *openai.Usage
+		want *pb.Usage
+	}{
+		{name: "nil", in: nil, want: nil},
+		{
+			name: "plain",
+			in:   &openai.Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15},
+			want: &pb.Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15},
+		},
+		{
+			name: "reasoning and cached details",
+			in: &openai.Usage{
+				PromptTokens: 1200, CompletionTokens: 800, TotalTokens: 2000,
+				PromptTokensDetails:     &openai.PromptTokensDetails{CachedTokens: 1024},
+				CompletionTokensDetails: &openai.CompletionTokensDetails{ReasoningTokens: 640},
+			},
+			want: &pb.Usage{PromptTokens: 1200, CompletionTokens: 800, TotalTokens: 2000, ReasoningTokens: 640, CachedPromptTokens: 1024},
+		},
+		{
+			name: "empty details",
+			in: &openai.Usage{
+				PromptTokens: 1, CompletionTokens: 1, TotalTokens: 2,
+				PromptTokensDetails:     &openai.PromptTokensDetails{},
+				CompletionTokensDetails: &openai.CompletionTokensDetails{},
+			},
+			want: &pb.Usage{PromptTokens: 1, CompletionTokens: 1, TotalTokens: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := convertUsage(tt.in); !proto.Equal(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// The details arrive as nested objects in the upstream usage JSON.
+func TestConvertUsageFromUpstreamJSON(t *testing.T) {
+	const body = `{
+		"prompt_tokens": 2006, "completion_tokens": 300, "total_tokens": 2306,
+		"prompt_tokens_details": {"cached_tokens": 1920},
+		"completion_tokens_details": {"reasoning_tokens": 256}
+	}`
+	var u openai.Usage
+	if err := json.Unmarshal([]byte(body), &u); err != nil {
+		t.Fatal(err)
+	}
+	want := &pb.Usage{PromptTokens: 2006, CompletionTokens: 300, TotalTokens: 2306, ReasoningTokens: 256, CachedPromptTokens: 1920}
+	if got := convertUsage(&u); !proto.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestEstimatePromptTokens(t *testing.T) {
+	user := func(content string) openai.ChatCompletionMessage {
+		return openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: content}
+	}
+	image := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, MultiContent: []openai.ChatMessagePart{
+		{Type: openai.ChatMessagePartTypeText, Text: "what is this?"},
+		{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: "data:image/png;base64,iVBORw0KGgo="}},
+	}}
+	toolCall := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, ToolCalls: []openai.ToolCall{
+		{Function: openai.FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+	}}
+
+	// 3 to prime the reply, plus per message 4 of overhead, a quarter token
+	// per ASCII character rounded up and one token per other character, or
+	// three quarters of one on the dense tokenizer.
+	tests := []struct {
+		name     string
+		messages []openai.ChatCompletionMessage
+		model    string
+		want     int
+	}{
+		{name: "no messages", model: "gpt-4", want: 3},
+		{name: "ASCII", messages: []openai.ChatCompletionMessage{user("hello world!")}, model: "gpt-4", want: 3 + 4 + 3},
+		{name: "ASCII rounds up", messages: []openai.ChatCompletionMessage{user("hello")}, model: "gpt-4", want: 3 + 4 + 2},
+		{name: "ASCII is the same on dense models", messages: []openai.ChatCompletionMessage{user("hello world!")}, model: "gpt-4o", want: 3 + 4 + 3},
+		{name: "CJK", messages: []openai.ChatCompletionMessage{user("你好世界你好世界")}, model: "gpt-4", want: 3 + 4 + 8},
+		{name: "CJK on gpt-4o", messages: []openai.ChatCompletionMessage{user("你好世界你好世界")}, model: "gpt-4o-mini", want: 3 + 4 + 6},
+		{name: "CJK on o1", messages: []openai.ChatCompletionMessage{user("你好世界你好世界")}, model: "o1", want: 3 + 4 + 6},
+		{name: "CJK on o3", messages: []openai.ChatCompletionMessage{user("你好世界你好世界")}, model: "o3-mini", want: 3 + 4 + 6},
+		{name: "mixed", messages: []openai.ChatCompletionMessage{user("hi 世界")}, model: "gpt-3.5-turbo", want: 3 + 4 + 1 + 2},
+		{name: "image", messages: []openai.ChatCompletionMessage{image}, model: "gpt-4o", want: 3 + 4 + 4 + imageTokens},
+		{name: "tool call arguments", messages: []openai.ChatCompletionMessage{toolCall}, model: "gpt-4o", want: 3 + 4 + 4},
+		{name: "per message overhead", messages: []openai.ChatCompletionMessage{user("hi"), user("hi"), user("hi")}, model: "gpt-4o", want: 3 + 3*(4+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := estimatePromptTokens(tt.messages, tt.model); got != tt.want {
+				t.Fatalf("estimatePromptTokens = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEstimateCompletionTokens(t *testing.T) {
+	for n, want := range map[int64]int{0: 0, 1: 1, 4: 1, 5: 2, 16: 4} {
+		if got := estimateCompletionTokens(n); got != want {
+			t.Errorf("estimateCompletionTokens(%d) = %d, want %d", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"slices"
+	"strings"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+// vault resolves upstream tokens held server-side, so callers need not carry
+// raw upstream keys.
+type vault struct {
+	c *conf.Proxy_Vault
+	// baseURL is upstream.base_url, the one url every vault token may reach.
+	baseURL string
+}
+
+// resolve picks the upstream token for a request sent to url. A raw token
+// wins, then an explicit token_ref, then the caller's configured default. A
+// caller may only name its default ref or one allowed for it, so it cannot bill
+// another tenant's upstream account, and a vault token is only sent to the base
+// URL or a url bound to its ref, so a caller cannot exfiltrate it to a server
+// of its own. Errors name the ref, never the token.
+func (v vault) resolve(token, ref, caller, url string) (string, error) {
+	if token != "" {
+		return token, nil
+	}
+	def := v.c.GetCallerRefs()[caller]
+	switch {
+	case ref == "":
+		ref = def
+	case ref != def && !slices.Contains(v.c.GetAllowedRefs()[caller].GetRefs(), ref):
+		return "", pb.ErrorForbidden("caller %s may not use token_ref %s", caller, ref)
+	}
+	if ref == "" {
+		return "", nil
+	}
+
+	token, ok := v.c.GetTokens()[ref]
+	if !ok {
+		return "", pb.ErrorInvalidParameter("unknown token_ref %s", ref)
+	}
+	if url != "" && !v.urlAllowed(ref, url) {
+		return "", pb.ErrorForbidden("token_ref %s may not be sent to url %s", ref, url)
+	}
+	return token, nil
+}
+
+func (v vault) urlAllowed(ref, url string) bool {
+	url = strings.TrimRight(url, "/")
+	if url == strings.TrimRight(v.baseURL, "/") {
+		return true
+	}
+	return slices.ContainsFunc(v.c.GetRefUrls()[ref].GetUrls(), func(u string) bool {
+		return strings.TrimRight(u, "/") == url
+	})
+}
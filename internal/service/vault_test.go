@@ -0,0 +1,156 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-kratos/kratos/v2/log"
+
+	pb "github.com/wolodata/proxy-service/api/proxy/v1"
+	"github.com/wolodata/proxy-service/internal/auth"
+	"github.com/wolodata/proxy-service/internal/conf"
+)
+
+const testSecret = "sk-SECRET"
+
+func testVault() vault {
+	return vault{
+		c: &conf.Proxy_Vault{
+			Tokens:     map[string]string{"shared": testSecret, "team": "sk-team", "other": "sk-other"},
+			CallerRefs: map[string]string{"alice": "shared"},
+			AllowedRefs: map[string]*conf.Proxy_Vault_Refs{
+				"alice": {Refs: []string{"team", "missing"}},
+			},
+			RefUrls: map[string]*conf.Proxy_Vault_Urls{
+				"team": {Urls: []string{"https://team.example.com/v1/"}},
+			},
+		},
+		baseURL: "https://api.example.com/v1",
+	}
+}
+
+func TestVaultResolve(t *testing.T) {
+	tests := []struct {
+		name                    string
+		token, ref, caller, url string
+		want                    string
+		wantErr                 func(error) bool
+	}{
+		{name: "raw token wins over ref", token: "sk-raw", ref: "team", caller: "alice", want: "sk-raw"},
+		{name: "raw token goes anywhere", token: "sk-raw", caller: "alice", url: "https://evil.example.com", want: "sk-raw"},
+		{name: "explicit ref wins over default", ref: "team", caller: "alice", want: "sk-team"},
+		{name: "caller default", caller: "alice", want: testSecret},
+		{name: "default ref named explicitly", ref: "shared", caller: "alice", want: testSecret},
+		{name: "no token at all", caller: "bob", want: ""},
+		{name: "ref not allowed for caller", ref: "other", caller: "alice", wantErr: pb.IsForbidden},
+		{name: "ref of anonymous caller", ref: "shared", caller: "", wantErr: pb.IsForbidden},
+		{name: "unknown ref", ref: "missing", caller: "alice", wantErr: pb.IsInvalidParameter},
+		{name: "base url", caller: "alice", url: "https://api.example.com/v1/", want: testSecret},
+		{name: "url bound to ref", ref: "team", caller: "alice", url: "https://team.example.com/v1", want: "sk-team"},
+		{name: "url bound to another ref", caller: "alice", url: "https://team.example.com/v1", wantErr: pb.IsForbidden},
+		{name: "foreign url", caller: "alice", url: "https://evil.example.com/v1", wantErr: pb.IsForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := testVault().resolve(tt.token, tt.ref, tt.caller, tt.url)
+			if tt.wantErr != nil {
+				if !tt.wantErr(err) {
+					t.Fatalf("err = %v", err)
+				}
+				if strings.Contains(err.Error(), "sk-") {
+					t.Fatalf("error %q leaks a token", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// vaultService serves alice's requests with her default vault token and
+// captures everything the service logs.
+func vaultService(t *testing.T, upstreamURL string) (*OpenAIService, *bytes.Buffer) {
+	t.Helper()
+	c := &conf.Proxy{
+		Upstream: &conf.Proxy_Upstream{BaseUrl: upstreamURL},
+		Vault:    testVault().c,
+	}
+	httpClient, err := NewHTTPClient(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	return NewOpenAIService(c, NewRuntimeConfig(c), httpClient, nil, NewQuotaStore(), log.NewStdLogger(&logs)), &logs
+}
+
+func TestVaultTokenNeverSentToCallerURL(t *testing.T) {
+	var leaked atomic.Int32
+	attacker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Authorization"), testSecret) {
+			leaked.Add(1)
+		}
+	}))
+	defer attacker.Close()
+
+	s, _ := vaultService(t, "https://api.example.com/v1")
+	ctx := auth.NewContext(context.Background(), "alice")
+
+	_, err := s.ValidateToken(ctx, &pb.ValidateTokenRequest{Url: attacker.URL})
+	if !pb.IsForbidden(err) {
+		t.Errorf("ValidateToken err = %v, want FORBIDDEN", err)
+	}
+	_, err = s.ChatCompletion(ctx, &pb.ChatCompletionRequest{Url: attacker.URL, Model: "gpt-4o", Messages: userMessages("hi")})
+	if !pb.IsForbidden(err) {
+		t.Errorf("ChatCompletion err = %v, want FORBIDDEN", err)
+	}
+	err = s.StreamChatCompletion(streamRequest(attacker.URL, "gpt-4o"), newFakeStream(ctx))
+	if !pb.IsForbidden(err) {
+		t.Errorf("StreamChatCompletion err = %v, want FORBIDDEN", err)
+	}
+
+	if n := leaked.Load(); n != 0 {
+		t.Fatalf("vault token sent to the caller's url %d times", n)
+	}
+}
+
+func TestVaultTokenRedactedFromLogs(t *testing.T) {
+	var auths atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer "+testSecret {
+			auths.Add(1)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":{"message":"bad request"}}`))
+	}))
+	defer upstream.Close()
+
+	s, logs := vaultService(t, upstream.URL)
+	ctx := auth.NewContext(context.Background(), "alice")
+
+	req := streamRequest("", "gpt-4o")
+	err := s.StreamChatCompletion(req, newFakeStream(ctx))
+	if err == nil {
+		t.Fatal("expected the upstream error")
+	}
+	if auths.Load() == 0 {
+		t.Fatal("the default vault token was not used")
+	}
+	_, err2 := s.ChatCompletion(ctx, &pb.ChatCompletionRequest{Model: "gpt-4o", Messages: userMessages("hi"), TokenRef: "other"})
+
+	for _, out := range []string{logs.String(), err.Error(), err2.Error()} {
+		if strings.Contains(out, testSecret) || strings.Contains(out, "sk-other") {
+			t.Fatalf("token leaked: %s", out)
+		}
+	}
+}